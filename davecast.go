@@ -17,11 +17,12 @@
 package main
 
 import (
-	"bufio"
-	"encoding/binary"
-	"encoding/hex"
+	"broadcast" // included
+	"config"    // included
+	"encoding/json"
+	"errors"
+	"events" // included
 	"fmt"
-	"io"
 	"log"
 	"net"
 	"net/http"
@@ -30,71 +31,138 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
-	"netc" // included
-	"ring" // included
+	"mcast"     // included
+	"metrics"   // included
+	"protocol"  // included
+	"ring"      // included
+	"splice"    // included
+	"status"    // included
+	"transport" // included
 )
 
-const use_netc = true
+const DAVECAST_CONTROL = 255 // internal only - switch upstream channel
 
-const DAVECAST_DATA = 0
-const DAVECAST_METADATA = 1
-const DAVECAST_ANNOUNCE = 2
-const DAVECAST_HEADERS = 3
-const DAVECAST_CONTROL = 255
+// defaults for the settings below, which may be changed in the
+// config file
 
-const ADTS_AAC_2C_44100_48000 = 0
-const ADTS_MP3_2C_44100_128000 = 1
-const ADTS_AAC_2C_44100_192000 = 2
-const ADTS_AAC_2C_44100_128000 = 3
-const ADTS_MP3_1C_44100_48000 = 4
-const ADTS_AAC_2C_44100_24000 = 5
-
-const DEPTH = 5000 // old
+const DEPTH = 5000 // old - x1000 for PDUs queued from each upstream
 const STREAM_DEPTH = 2000
 
+// audio kept per mountpoint for listeners to read from - ~16s of a
+// 128k stream; listeners which fall further behind are disconnected
+const BUFFER_SIZE = 256 * 1024
+
+// backlog sent to new listeners by default, and in place of a duration
+// for streams which have not announced their bitrate
+const BURST_SIZE = 64 * 1024
+
 const DAVECHAN_ACK = 0
 const DAVECHAN_NAK = 1
 const DAVECHAN_PUB = 2
 const DAVECHAN_DEL = 1
 const DAVECHAN_SUB = 4
 const DAVECHAN_LST = 5
+const DAVECHAN_UNS = 6
+const DAVECHAN_SND = 7
 
 // 6 seconds seems to work well with mplayer's default 320k buffer
 // and a 48k stream. icecast can be used to buffer higher bitrates.
 // a delay function on output would be useful to offset timeout
 
+// we present ourselves as Icecast to players and monitoring tools
+const SERVER_ID = "Icecast 2.3.3-kh11"
+
+// defaults, which may be changed with timing in the config file
 const BLIP_TIME = 6  // time after which we consider a stream to have stalled
 const FAIL_TIME = 10 // give up if mountpoint cannot be recovered after this
 const SYNC_TIME = 15 // stalled stream (missing a frame) will resync after this
 const DEAD_TIME = 20 // expire streams completely if not re-synced after this
+const STALL_TIME = 0 // fail over after this if a backup is ready (0 - BLIP_TIME)
+
+// a stall is never shorter than this many frames, however short
+// the stall time is set, as sources and networks are not that smooth
+const STALL_FRAMES = 4
+
+// on failover, frames of a backup are matched to those sent at most
+// this far either side of where arrival times would switch it in
+const SPLICE_SKEW = 3 * time.Second
+
+// a PDU missing from a stream is requested from the relays as soon as
+// the gap is seen, then again every NAK_RETRY, up to this many times,
+// before waiting for SYNC_TIME
+const NAK_TRIES = 3
+const NAK_RETRY = time.Second
+
+// NAKs sent for a missing sequence number
+type nak struct {
+	tries int
+	last  nanosec
+}
+
+// the latest parity group seen on a stream, from which those to come
+// are expected to follow on - a PDU missing from a group is only taken
+// as a gap once the group has closed and parity has had its chance
+type groups struct {
+	last uint64 // sequence number of the last PDU of the group
+	size uint64 // 0 if no parity has been seen
+}
+
+// open reports whether seq falls in a group which has yet to close, by
+// top (the latest PDU received) being beyond it
+func (g groups) open(seq, top uint64) bool {
+	if g.size == 0 || seq <= g.last { // parity for its group has arrived
+		return false
+	}
+	end := g.last + (seq-g.last+g.size-1)/g.size*g.size
+	return end >= top
+}
 
 
 
 type nanosec int64
 type sec int64
 type davecast struct {
-	time       nanosec        // timestamp at message receive time
-	mtype      int            // message type
-	replica    int            // replica number from encoder
-	uuid       string         // unique stream id
-	seq        uint64         // sequence number
-	data       []byte         // ADTS frame data
-	mountpoint string         // name of mountpoint in announce message
-	metadata   string         // metadata message contents
-	atype      int            // audio type
-	headers    string         // HTTP headers
-	last       sec            // timestamp of last processed message
-	upstream   chan *davecast // channel switch message
+	time       nanosec           // timestamp at message receive time
+	version    int               // protocol version of received message
+	flags      int               // v2 header flags
+	keyid      string            // id of key which signed message
+	mtype      int               // message type
+	replica    int               // replica number from encoder
+	uuid       string            // unique stream id
+	seq        uint64            // sequence number
+	data       []byte            // ADTS frame data (or parity)
+	pts        int64             // encoder's capture time of frame (ns since 1970), 0 if not stamped
+	samples    uint64            // samples in the stream before frame, if stamped
+	group      []uint64          // sequence numbers covered by parity
+	mountpoint string            // name of mountpoint in announce message
+	metadata   protocol.Metadata // metadata message contents
+	codec      protocol.Codec    // audio parameters from announce
+	headers    string            // HTTP headers
+	last       sec               // timestamp of last processed message
+	upstream   chan *davecast    // channel switch message
 }
 
 type davechan struct {
 	davecast chan *davecast
 	reply    chan davechan
-	atype    int
+	codec    protocol.Codec
 	op       int
 	key      string
 	list     []string
+	buffer   *broadcast.Buffer  // mountpoint audio for listeners
+	pdu      *davecast          // latest headers, metadata, etc.
+	stat     *status.Mountpoint // mountpoint's entry in the admin API
+}
+
+// requests to MaintainSubscriptions
+type subreq struct {
+	op       int           // DAVECHAN_PUB/DEL relay connection, SUB/UNS patterns, SND msg
+	conn     chan []byte   // SUBSCRIBE/NAK messages for a relay connection
+	patterns []string      // mountpoint names or patterns
+	msg      []byte        // message to send to every relay
+	reply    chan []string // current subscriptions
 }
 
 // used by stream handler
@@ -102,6 +170,7 @@ type stream struct {
 	davecast chan *davecast
 	davechan chan davechan
 	last     sec
+	stat     *status.Mountpoint
 }
 
 const LOG_CRIT = 0
@@ -110,56 +179,446 @@ const LOG_NOTI = 2
 const LOG_INFO = 3
 const LOG_DBUG = 4
 
-var log_level int = LOG_NOTI
+// settings from the arguments and environment, with those from the
+// config file (CONFIG) taking precedence. Replaced whole when the file
+// is reloaded (SIGHUP), so read them with conf() when needed.
+type settings struct {
+	log_level      int
+	listen         string   // edge: port for listeners
+	sources        string   // relay: port sources send to
+	clients        string   // relay: port edges and relays connect to
+	multicast      []string // relay: groups to send everything to
+	upstreams      []string // relays, or multicast groups for relays
+	subscribe      []string // edge: mountpoints to ask the relays for
+	timing         timing   // for mountpoints without their own
+	stream_depth   int      // PDUs queued for each stream and mountpoint
+	upstream_depth int      // PDUs queued from each upstream relay
+	buffer_size    int      // audio held for listeners of a mountpoint
+	burst          config.Burst // backlog sent to new listeners, as icecast's burst-size
+	metaint        int          // ICY metadata interval for listeners
+	splice         bool         // match frames to switch in a backup
+	mountpoints    []config.Mountpoint // overrides, see override()
+}
+
+// failover timing - see BLIP_TIME etc. Streams are only checked every
+// second, so sync and dead are whole seconds.
+type timing struct {
+	blip, fail, stall time.Duration
+	sync, dead        time.Duration
+}
+
+var current atomic.Value // *settings
+
+func conf() *settings {
+	return current.Load().(*settings)
+}
+
 var req_mounts chan davechan
 var req_stream chan davechan
+var req_subs chan subreq
+var stats = status.New() // mountpoints and streams for the admin API
+var event_log *events.Log // lifecycle events, if EVENTS is set
+
+// served at /metrics on edges, and on relays if METRICS is set
+var (
+	metric_received = metrics.Default.NewCounter("davecast_pdus_received_total",
+		"PDUs received, by path", "path")
+	metric_dropped = metrics.Default.NewCounter("davecast_pdus_dropped_total",
+		"PDUs dropped, by where and why", "where", "reason")
+	metric_gaps = metrics.Default.NewCounter("davecast_sequence_gaps_total",
+		"Sequence numbers found missing from streams", "mountpoint")
+	metric_requested = metrics.Default.NewCounter("davecast_retransmits_requested_total",
+		"Missing sequence numbers requested from relays", "mountpoint")
+	metric_recovered = metrics.Default.NewCounter("davecast_parity_recovered_total",
+		"Missing PDUs rebuilt from parity", "mountpoint")
+	metric_resyncs = metrics.Default.NewCounter("davecast_resyncs_total",
+		"Streams resynchronised after stalling", "mountpoint")
+	metric_failovers = metrics.Default.NewCounter("davecast_failovers_total",
+		"Mountpoints stalled and failed over to another stream", "mountpoint")
+	metric_bytes_sent = metrics.Default.NewCounter("davecast_bytes_sent_total",
+		"Audio bytes sent to listeners", "mountpoint")
+	metric_relay_bytes = metrics.Default.NewCounter("davecast_relay_bytes_sent_total",
+		"Bytes sent to relay clients")
+	metric_relay_clients = metrics.Default.NewGauge("davecast_relay_clients",
+		"Relay clients connected (edges, relays, multicast groups)")
+	metric_relay_queue = metrics.Default.NewGauge("davecast_relay_queue_depth",
+		"PDUs waiting to be sent to each relay client", "client")
+)
+var keys protocol.Keyring // PDUs must be signed if set (KEYS=file)
 
 func logit(level int, format string, args ...interface{}) {
-	if log_level >= level { log.Printf(format, args...) }
+	if conf().log_level >= level { log.Printf(format, args...) }
 }
 
 func main() {
-	if len(os.Args) > 1 {
-		if os.Args[1] == "-r" {
-			RelayMain()
-		} else {
-			DavecastMain()
+	relay := len(os.Args) > 1 && os.Args[1] == "-r"
+	file := os.Getenv("CONFIG")
+
+	base := environment(relay)
+	s := *base
+
+	if file != "" {
+		c, err := config.Load(file)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := s.apply(c, relay); err != nil {
+			log.Fatal(err)
 		}
 	}
+
+	current.Store(&s)
+
+	if file := os.Getenv("KEYS"); file != "" {
+		k, err := protocol.LoadKeys(file)
+		if err != nil {
+			log.Fatal(err)
+		}
+		keys = k
+		log.Printf("Loaded %d keys from %s\n", len(keys), file)
+	}
+
+	// JSON lines file (or "-" for stdout) for failovers, resyncs, etc.
+	if file := os.Getenv("EVENTS"); file != "" {
+		l, err := events.Open(file)
+		if err != nil {
+			log.Fatal(err)
+		}
+		event_log = l
+	}
+
+	if relay {
+		RelayMain(base, file)
+	} else if len(os.Args) > 1 || file != "" {
+		DavecastMain(base, file)
+	}
 }
 
-func DavecastMain() {
+// settings from the compiled in defaults, the environment and the
+// arguments, for the config file to be applied over
+func environment(relay bool) *settings {
+	s := &settings{log_level: LOG_NOTI, listen: "8000", sources: "9001", clients: "8001",
+		timing: timing{blip: BLIP_TIME * time.Second, fail: FAIL_TIME * time.Second,
+			stall: STALL_TIME * time.Second, sync: SYNC_TIME * time.Second,
+			dead: DEAD_TIME * time.Second},
+		stream_depth: STREAM_DEPTH, upstream_depth: DEPTH * 1000, // ??? what should this be
+		buffer_size: BUFFER_SIZE, burst: config.Burst{Bytes: BURST_SIZE}, metaint: 8000}
 
-	port := 8000
-	
 	if d, err := strconv.Atoi(os.Getenv("DEBUG")); err == nil {
-		log_level = d
+		s.log_level = d
 	}
 
-	timer_start()
-	log.Printf("Using %d procs\n", runtime.GOMAXPROCS(0))
-	time.Sleep(time.Second * 4)
+	// backlog for new listeners: bytes (eg. 65536) or time (eg. 4s)
+	if b := os.Getenv("BURST"); b != "" {
+		if err := s.burst.Set(b); err != nil {
+			log.Fatal("BURST must be a number of bytes or a duration")
+		}
+	}
+
+	list := func(v string) []string {
+		return strings.FieldsFunc(v, func(r rune) bool { return r == ',' || r == ' ' })
+	}
 
-	if len(os.Args) > 1 {
-		if p, err := strconv.Atoi(os.Args[1]); err != nil {
-			log.Fatal("port must be an integer")
+	// metadata interval, optionally per mountpoint: "16000,Heart*=4096"
+	for _, m := range list(os.Getenv("METAINT")) {
+		kv := strings.SplitN(m, "=", 2)
+		n, err := strconv.Atoi(kv[len(kv)-1])
+		if err != nil || n < 0 {
+			log.Fatal("METAINT must be a number of bytes")
+		}
+		if len(kv) == 2 {
+			s.mountpoints = append(s.mountpoints, config.Mountpoint{Match: kv[0], Metaint: &n})
 		} else {
-			port = p
+			s.metaint = n
+		}
+	}
+
+	// mountpoints (or patterns) to ask the relays for, eg. "Capital*"
+	s.subscribe = list(os.Getenv("SUBSCRIBE"))
+
+	if len(s.subscribe) == 0 {
+		s.subscribe = []string{"*"}
+	}
+
+	// multicast groups to relay everything to, with options, eg.
+	// MULTICAST="239.1.2.3@9000,ttl=4,if=eth1,loop=0"
+	s.multicast = strings.Fields(os.Getenv("MULTICAST"))
+
+	if relay {
+		if len(os.Args) > 2 {
+			s.sources = os.Args[2]
+		}
+		if len(os.Args) > 3 {
+			s.clients = os.Args[3]
+		}
+		if len(os.Args) > 4 {
+			s.upstreams = os.Args[4:]
+		}
+	} else {
+		if len(os.Args) > 1 {
+			s.listen = os.Args[1]
+		}
+		if len(os.Args) > 2 {
+			s.upstreams = os.Args[2:]
+		}
+	}
+
+	if err := s.check(relay); err != nil {
+		log.Fatal(err)
+	}
+
+	return s
+}
+
+// apply the config file over the settings
+func (s *settings) apply(c *config.Config, relay bool) error {
+	if c.LogLevel != nil {
+		s.log_level = *c.LogLevel
+	}
+
+	set := func(v *string, c string) {
+		if c != "" {
+			*v = c
+		}
+	}
+
+	set(&s.listen, c.Listen)
+	set(&s.sources, c.Sources)
+	set(&s.clients, c.Clients)
+
+	if c.Multicast != nil {
+		s.multicast = c.Multicast
+	}
+
+	if c.Upstreams != nil {
+		s.upstreams = c.Upstreams
+	}
+
+	if len(c.Subscribe) > 0 {
+		s.subscribe = c.Subscribe
+	}
+
+	if err := s.timing.apply(c.Timing); err != nil {
+		return err
+	}
+
+	for _, d := range []struct {
+		v *int
+		n int
+	}{{&s.stream_depth, c.StreamDepth}, {&s.upstream_depth, c.UpstreamDepth},
+		{&s.buffer_size, c.BufferSize}} {
+		if d.n < 0 {
+			return errors.New("depths and sizes must be positive")
+		}
+		if d.n > 0 {
+			*d.v = d.n
 		}
-		log.Println(port, len(os.Args), os.Args)
 	}
 
+	if c.Burst != nil {
+		s.burst = *c.Burst
+	}
+
+	if c.Metaint != nil {
+		s.metaint = *c.Metaint
+	}
+
+	if c.Splice != nil {
+		s.splice = *c.Splice
+	}
+
+	// the file's overrides come before those from METAINT
+	s.mountpoints = append(append([]config.Mountpoint{}, c.Mountpoints...), s.mountpoints...)
+
+	return s.check(relay)
+}
+
+func (s *settings) check(relay bool) error {
+	if !relay {
+		if _, err := strconv.Atoi(s.listen); err != nil {
+			return errors.New("port must be an integer")
+		}
+	}
+
+	for _, g := range append(append([]string{}, s.upstreams...), s.multicast...) {
+		if strings.Contains(g, "@") {
+			if _, _, err := multicast(g); err != nil {
+				return err
+			}
+		}
+	}
+
+	if s.metaint < 0 {
+		return errors.New("metaint must be a number of bytes")
+	}
+
+	for _, m := range s.mountpoints {
+		switch {
+		case m.Match == "":
+			return errors.New("mountpoint overrides need a name or pattern to match")
+		case m.BufferSize < 0, m.Metaint != nil && *m.Metaint < 0, m.Timeout < 0:
+			return errors.New("bad override for " + m.Match)
+		}
+
+		t := s.timing // only checked here - see Timing()
+		if err := t.apply(m.Timing); err != nil {
+			return errors.New(m.Match + ": " + err.Error())
+		}
+	}
+
+	return nil
+}
+
+// re-apply the config file on SIGHUP, then call update to act on any
+// changes which need more than the new settings being read
+func reload(base *settings, file string, relay bool, update func(old, s *settings)) {
+	config.Reload(file, func(c *config.Config) {
+		s := *base
+		if err := s.apply(c, relay); err != nil {
+			logit(LOG_CRIT, "config not applied: %v\n", err)
+			return
+		}
+		old := conf()
+		current.Store(&s)
+		update(old, &s)
+	})
+}
+
+// override for a mountpoint - the entry naming it exactly, or else
+// the first whose pattern matches, or none
+func (s *settings) override(mountpoint string) config.Mountpoint {
+	for _, m := range s.mountpoints {
+		if m.Match == mountpoint {
+			return m
+		}
+	}
+	for _, m := range s.mountpoints {
+		if protocol.Match([]string{m.Match}, mountpoint) {
+			return m
+		}
+	}
+	return config.Mountpoint{}
+}
+
+// set the times given in the config file
+func (t *timing) apply(c config.Timing) error {
+	for _, v := range []struct {
+		v    *time.Duration
+		d    config.Duration
+		secs bool
+	}{{&t.blip, c.Blip, false}, {&t.fail, c.Fail, false}, {&t.stall, c.Stall, false},
+		{&t.sync, c.Sync, true}, {&t.dead, c.Dead, true}} {
+		d := time.Duration(v.d)
+		switch {
+		case d == 0:
+			continue
+		case d < time.Millisecond:
+			return errors.New("timing must be at least a millisecond")
+		case v.secs && d < time.Second:
+			return errors.New("sync and dead must be at least a second")
+		case v.secs:
+			d = d.Truncate(time.Second)
+		}
+		*v.v = d
+	}
+	return nil
+}
+
+// as shown by the admin API
+func (t timing) status() status.Timing {
+	return status.Timing{Blip: t.blip.Seconds(), Fail: t.fail.Seconds(),
+		Stall: t.stall.Seconds(), Sync: t.sync.Seconds(), Dead: t.dead.Seconds()}
+}
+
+// failover timing for a mountpoint - its override's profile over the
+// defaults
+func Timing(mountpoint string) timing {
+	s := conf()
+	t := s.timing
+	t.apply(s.override(mountpoint).Timing) // checked with the settings
+	return t
+}
+
+// upstream relays (or multicast groups) connected to, by address, so
+// that those dropped from the config file can be closed
+type upstreams map[string]chan struct{}
+
+// connect to any new addresses with start, and close those not listed
+func (u upstreams) update(list []string, start func(addr string, done chan struct{})) {
+	for addr, done := range u {
+		if !contains(list, addr) {
+			logit(LOG_WARN, "upstream dropped: %s\n", addr)
+			close(done)
+			delete(u, addr)
+		}
+	}
+
+	for _, addr := range list {
+		if _, ok := u[addr]; !ok {
+			logit(LOG_INFO, "upstream: %s\n", addr)
+			done := make(chan struct{})
+			u[addr] = done
+			go start(addr, done)
+		}
+	}
+}
+
+func DavecastMain(base *settings, file string) {
+
+	timer_start()
+	log.Printf("Using %d procs\n", runtime.GOMAXPROCS(0))
+	time.Sleep(time.Second * 4)
+
+	port, _ := strconv.Atoi(conf().listen)
+	log.Println(port, len(os.Args), os.Args)
+
 	req_mounts = make(chan davechan, 1000)
 	go MaintainMountpoints(req_mounts)
 	
 	req_stream = make(chan davechan, 1000)
 	go MaintainStreams(req_stream)
 
-	for n := 2; n < len(os.Args); n++ {
-		logit(LOG_INFO, "tcp server: %s", os.Args[n])
-		channel := make(chan []byte, DEPTH*1000) // ??? what should this be
+	req_subs = make(chan subreq, 100)
+	go MaintainSubscriptions(req_subs, conf().subscribe)
+
+	// each upstream relay has its own router, which stops once the
+	// connection to the relay has been closed for good
+	connect := func(addr string, done chan struct{}) {
+		channel := make(chan []byte, conf().upstream_depth)
 		go PDURouter(channel)
-		go TCPClient(os.Args[n], channel)
+		TCPClient(addr, channel, done)
+		close(channel)
+	}
+
+	connected := upstreams{}
+	connected.update(conf().upstreams, connect)
+
+	if file != "" {
+		reload(base, file, false, func(old, s *settings) {
+			if s.listen != old.listen {
+				logit(LOG_WARN, "port %s needs a restart to change\n", s.listen)
+			}
+
+			var add, del []string
+			for _, p := range s.subscribe {
+				if !contains(old.subscribe, p) {
+					add = append(add, p)
+				}
+			}
+			for _, p := range old.subscribe {
+				if !contains(s.subscribe, p) {
+					del = append(del, p)
+				}
+			}
+			if len(add) > 0 {
+				req_subs <- subreq{op: DAVECHAN_SUB, patterns: add}
+			}
+			if len(del) > 0 {
+				req_subs <- subreq{op: DAVECHAN_UNS, patterns: del}
+			}
+
+			connected.update(s.upstreams, connect)
+		})
 	}
 
 	IcecastServer(port)
@@ -167,6 +626,41 @@ func DavecastMain() {
 
 func IcecastServer(port int) {
 
+	// mountpoints with their streams, listeners, etc. as JSON -
+	// all of them, or only those named (?mount=name&mount=name...)
+	http.HandleFunc("/admin/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		e := json.NewEncoder(w)
+		e.SetIndent("", "  ")
+		e.Encode(map[string]interface{}{"mountpoints": stats.Report(r.URL.Query()["mount"]...)})
+	})
+
+	http.HandleFunc("/metrics", metrics.Handler)
+
+	metrics.Default.GaugeFunc("davecast_listeners", "Listeners connected",
+		[]string{"mountpoint"}, func(set func(int64, ...string)) {
+			for _, m := range stats.Report() {
+				set(int64(m.Listeners), m.Name)
+			}
+		})
+
+	// Icecast's status pages, for players and monitoring tools
+	http.HandleFunc("/status-json.xsl", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		json.NewEncoder(w).Encode(stats.Icestats(SERVER_ID, r.Host))
+	})
+
+	http.HandleFunc("/status.xsl", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		stats.Icestats(SERVER_ID, r.Host).WriteHTML(w)
+	})
+
+	http.HandleFunc("/admin/stats", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+		stats.Icestats(SERVER_ID, r.Host).WriteXML(w)
+	})
+
 	// return a list of mountpoints, one per line with leading "/"
 	http.HandleFunc("/admin/", func(w http.ResponseWriter, r *http.Request) {
 		query := davechan{op: DAVECHAN_LST, reply: make(chan davechan, 10)}
@@ -177,6 +671,23 @@ func IcecastServer(port int) {
 		}
 	})
 
+	// add or drop subscriptions (?mount=name&mount=pattern...) and
+	// return the list of subscriptions in effect, one per line
+	subscriptions := func(op int) func(http.ResponseWriter, *http.Request) {
+		return func(w http.ResponseWriter, r *http.Request) {
+			query := subreq{op: op, reply: make(chan []string, 1)}
+			query.patterns = r.URL.Query()["mount"]
+			req_subs <- query
+			for _, p := range <-query.reply {
+				fmt.Fprintf(w, "%s\n", p)
+			}
+		}
+	}
+
+	http.HandleFunc("/admin/subscriptions", subscriptions(DAVECHAN_LST))
+	http.HandleFunc("/admin/subscribe", subscriptions(DAVECHAN_SUB))
+	http.HandleFunc("/admin/unsubscribe", subscriptions(DAVECHAN_UNS))
+
 	// serve stream to client
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		r.ProtoMinor = 0 // Icecast likes HTTP/1.0
@@ -190,63 +701,51 @@ func IcecastServer(port int) {
 		}
 
 		// subscribe to mountpoint upstream
-		stream := make(chan *davecast, STREAM_DEPTH)
-		query := davechan{key: mountpoint, op: DAVECHAN_SUB, davecast: stream}
-		query.reply = make(chan davechan, 10)
+		query := davechan{key: mountpoint, op: DAVECHAN_SUB}
+		query.reply = make(chan davechan, 1)
 		req_mounts <- query
 
-		if reply := <-query.reply; reply.op != DAVECHAN_ACK { // not present
+		var reply davechan
+
+		select {
+		case reply = <-query.reply:
+		case <-time.After(Timing(mountpoint).blip): // mountpoint went away
+		}
+
+		if reply.op != DAVECHAN_ACK { // not present
 			logit(LOG_NOTI, "/%s 404\n", mountpoint)
 			w.WriteHeader(http.StatusNotFound)
 			return
 		}
 
-		metaint := 8000 // metadata interval - should be configurable
-		metadata := []byte{}
-
-		// read first frame to get codec type, http headers, etc
-		pdu, ok := <-stream
-
-		if !ok {
-			logit(LOG_NOTI, "/%s 500\n", mountpoint)
-			w.WriteHeader(http.StatusInternalServerError)
-			return
+		// only players which ask for metadata can cope with it
+		metaint := 0
+		if r.Header.Get("Icy-MetaData") == "1" {
+			metaint = MetadataInterval(mountpoint)
 		}
 
 		logit(LOG_NOTI, "/%s 200\n", mountpoint)
 
-		p := []string{"audio/aacp", "2", "44100", "48"}
+		pdu := reply.pdu
+		codec := pdu.codec
 
-		switch pdu.atype {
-		case ADTS_AAC_2C_44100_48000:
-			p = []string{"audio/aacp", "2", "44100", "48"}
-		case ADTS_MP3_2C_44100_128000:
-			p = []string{"audio/mpeg", "2", "44100", "128"}
-		case ADTS_AAC_2C_44100_192000:
-			p = []string{"audio/aacp", "2", "44100", "192"}
-		case ADTS_AAC_2C_44100_128000:
-			p = []string{"audio/aacp", "2", "44100", "128"}
-		case ADTS_MP3_1C_44100_48000:
-			p = []string{"audio/mpeg", "1", "44100", "48"}
-		case ADTS_AAC_2C_44100_24000:
-			p = []string{"audio/aacp", "2", "44100", "24"}
-		}
-
-		w.Header().Set("Content-Type", p[0])
+		w.Header().Set("Content-Type", codec.ContentType())
 		w.Header().Set("ice-audio-info",
-			fmt.Sprintf("ice-samplerate=%s;ice-bitrate=%s;ice-channels=%s",
-				p[2], p[3], p[1]))
-		w.Header().Set("icy-br", p[3])
+			fmt.Sprintf("ice-samplerate=%d;ice-bitrate=%d;ice-channels=%d",
+				codec.SampleRate, codec.Kbps(), codec.Channels))
+		w.Header().Set("icy-br", fmt.Sprintf("%d", codec.Kbps()))
 		w.Header().Set("icy-private", "0")
 		w.Header().Set("icy-pub", "0")
-		w.Header().Set("icy-metaint", fmt.Sprintf("%d", metaint))
+		if metaint > 0 {
+			w.Header().Set("icy-metaint", fmt.Sprintf("%d", metaint))
+		}
 
-		for _, v := range strings.Split(pdu.headers, "\n") {
-			if strings.ContainsAny(v, "\r") {
-				h := strings.Split(v, "\r")
-				if len(h[0]) > 0 {
-					w.Header().Set(h[0], h[1])
-				}
+		// codec parameters take precedence over the source's headers
+		for k, v := range headers(pdu.headers) {
+			switch k {
+			case "", "Content-Type", "Icy-Br", "Ice-Audio-Info", "Icy-Metaint":
+			default:
+				w.Header().Set(k, v)
 			}
 		}
 
@@ -254,7 +753,7 @@ func IcecastServer(port int) {
 		w.Header().Set("Pragma", "no-cache")
 		w.Header().Set("Accept-Ranges", "none")
 		w.Header().Set("Connection", "close")
-		w.Header().Set("Server", "Icecast 2.3.3-kh11")
+		w.Header().Set("Server", SERVER_ID)
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		w.Header().Set("Access-Control-Allow-Headers",
 			"Origin, Accept, X-Requested-With, Content-Type")
@@ -262,103 +761,176 @@ func IcecastServer(port int) {
 		w.Header().Set("Expires", "Mon, 26 Jul 1997 05:00:00 GMT")
 		w.Header().Del("Transfer-Encoding")
 		w.WriteHeader(http.StatusOK)
-		
-		sent := 0
-		total := 0
 
-		// keep sending frames until they stop or client disconnects
-		for {
-			select {
-			case <-time.After(time.Second * DEAD_TIME):
-				return
+		off := reply.buffer.Burst(burst(mountpoint, codec))
+		err := Listen(w, f, reply.buffer, off, metaint, reply.stat)
 
-			case m, more := <-stream:
+		if err == broadcast.ErrLagged || errors.Is(err, os.ErrDeadlineExceeded) {
+			event_log.Log(events.Event{Event: events.CLIENT_KILL, Mountpoint: mountpoint,
+				Client: r.RemoteAddr, Reason: err.Error()})
+		}
+	})
 
-				if !more {
-					return
-				}
+	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", port), nil))
+}
 
-				switch m.mtype {
+// HTTP headers from a HEADERS message ("key\rvalue\n..."), by
+// canonical key
+func headers(s string) map[string]string {
+	h := make(map[string]string)
+	for _, v := range strings.Split(s, "\n") {
+		if kv := strings.SplitN(v, "\r", 2); len(kv) == 2 {
+			h[http.CanonicalHeaderKey(kv[0])] = kv[1]
+		}
+	}
+	return h
+}
 
-				case DAVECAST_METADATA:
-					metadata = []byte(m.metadata)
+// ICY metadata interval for a mountpoint - from the first matching
+// override (or METAINT pattern), or the default
+func MetadataInterval(mountpoint string) int {
+	s := conf()
+	if m := s.override(mountpoint); m.Metaint != nil {
+		return *m.Metaint
+	}
+	return s.metaint
+}
 
-				case DAVECAST_DATA:
-					todo := len(m.data)
-					start := 0
+// whether to match frames when failing a mountpoint over to a backup
+func Splice(mountpoint string) bool {
+	s := conf()
+	if m := s.override(mountpoint); m.Splice != nil {
+		return *m.Splice
+	}
+	return s.splice
+}
 
-					for todo > 0 {
-						chunk := todo
+// size of the backlog sent to a new listener - BURST as a duration
+// is converted to bytes at the codec's bitrate, if known
+func burst(mountpoint string, codec protocol.Codec) int {
+	s := conf()
+	b := s.burst
+	if m := s.override(mountpoint); m.Burst != nil {
+		b = *m.Burst
+	}
+	if b.Time != 0 && codec.Bitrate == 0 {
+		return BURST_SIZE
+	}
+	return b.Size(codec.Bitrate)
+}
 
-						if sent+todo > metaint {
-							chunk = metaint - sent
-						}
-						end := start + chunk
+// audio held for a mountpoint's listeners
+func BufferSize(mountpoint string) int {
+	s := conf()
+	if m := s.override(mountpoint); m.BufferSize > 0 {
+		return m.BufferSize
+	}
+	return s.buffer_size
+}
 
-						_, e := w.Write(m.data[start:end])
-						if e != nil { // client disconnect
-							logit(LOG_DBUG, "Client disconnected %v\n", e)
-							return
-						}
-						f.Flush()
-
-						todo -= chunk
-						start += chunk
-						sent += chunk
-						sent = sent % metaint
-						total += sent
-
-						if sent == 0 {
-							// time for metadata
-							metalen := len(metadata)
-							len_div_16 := metalen >> 4
-							if metalen%16 > 0 {
-								len_div_16 += 1
-							}
-							b := make([]byte, 1+len_div_16*16)
-							b[0] = byte(len_div_16)
-							copy(b[1:], metadata[:])
-
-							_, e := w.Write(b[:])
-							if e != nil {
-								logit(LOG_DBUG, "Client disconnected %v\n", e)
-								return
-							}
-							f.Flush()
-						}
-					}
+// how long a listener may stop reading before it is dropped
+func ListenerTimeout(mountpoint string) time.Duration {
+	s := conf()
+	if m := s.override(mountpoint); m.Timeout > 0 {
+		return time.Duration(m.Timeout)
+	}
+	return Timing(mountpoint).blip
+}
+
+// send a mountpoint's audio to a listener from the shared buffer,
+// starting at offset off (a frame boundary, or the live edge), with
+// ICY metadata every metaint bytes (never if 0). Each pass sends
+// everything written since the last in one write. Returns why the
+// listener was dropped, if it was.
+func Listen(w http.ResponseWriter, f http.Flusher, buffer *broadcast.Buffer, off uint64, metaint int, stat *status.Mountpoint) error {
+	rc := http.NewResponseController(w)
+
+	bytes_sent := metric_bytes_sent.With(stat.Name)
+	timeout := ListenerTimeout(stat.Name)
+	dead := Timing(stat.Name).dead
+
+	stat.Update(func(m *status.Mountpoint) {
+		if m.Listeners++; m.Listeners > m.ListenerPeak {
+			m.ListenerPeak = m.Listeners
+		}
+	})
+	defer stat.Update(func(m *status.Mountpoint) { m.Listeners-- })
+	sent := 0 // bytes since the last metadata
+	chunk := make([]byte, 4096)
+	var out []byte
+
+	for {
+		n, err := buffer.Read(off, chunk, dead)
+
+		if err != nil {
+			if err == broadcast.ErrLagged {
+				logit(LOG_CRIT, "| listener lagged\n")
+			}
+			return err
+		}
+
+		out = out[:0]
+
+		for data := chunk[:n]; len(data) > 0; {
+			c := len(data)
+			if metaint > 0 && sent+c > metaint {
+				c = metaint - sent
+			}
+
+			out = append(out, data[:c]...)
+			data = data[c:]
+			off += uint64(c)
+			sent += c
+
+			if metaint > 0 && sent == metaint { // time for metadata
+				if block := buffer.Metadata(off); block != nil {
+					out = append(out, block...)
+				} else {
+					out = append(out, 0) // none yet
 				}
+				sent = 0
 			}
 		}
-	})
 
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", port), nil))
-}
+		// a listener which stops reading is dropped, not waited for
+		rc.SetWriteDeadline(time.Now().Add(timeout))
 
-// connects to upstream relay and receives a flood of frames
-func TCPClient(addr string, messages chan []byte) {
+		n, e := w.Write(out)
+		stat.Sent(n)
+		bytes_sent.Add(int64(n))
 
-	if use_netc {
-		runtime.LockOSThread()
+		if e != nil { // client disconnect
+			logit(LOG_DBUG, "Client disconnected %v\n", e)
+			return e
+		}
+		f.Flush()
 	}
+}
 
-	defer func() {
-		runtime.UnlockOSThread()
-		time.Sleep(10 * time.Second)
-		go TCPClient(addr, messages)
-	}()
-
-	var conn io.ReadCloser
-	var err error
+// connects to upstream relay and receives a flood of frames,
+// reconnecting whenever the connection fails until done is closed
+func TCPClient(addr string, messages chan []byte, done chan struct{}) {
+	for {
+		TCPSession(addr, messages, done)
 
-	if use_netc {
-		conn, err = netc.Dial("tcp", addr)
-	} else {
-		conn, err = net.Dial("tcp", addr)
+		select {
+		case <-done:
+			return
+		case <-time.After(10 * time.Second):
+		}
 	}
+}
+
+func TCPSession(addr string, messages chan []byte, done chan struct{}) {
+	// the relay has nothing to send while none of the mountpoints
+	// subscribed to are up, so rely on TCP keepalive to spot a dead one
+	config := transport.Defaults
+	config.ReadTimeout = 0
+
+	conn, err := transport.Dial("tcp", addr, config)
 
 	if err != nil {
-		logit(LOG_WARN, "tcp failed: %s\n", addr)
+		logit(LOG_WARN, "tcp failed: %v\n", err)
 		return
 	}
 
@@ -367,130 +939,182 @@ func TCPClient(addr string, messages chan []byte) {
 		conn.Close()
 	}()
 
+	closed := make(chan struct{})
+	defer close(closed)
+
+	go func() {
+		select {
+		case <-done: // dropped from the config file
+			conn.Close()
+		case <-closed:
+		}
+	}()
+
 	logit(LOG_WARN, "tcp opened: %s\n", addr)
 
-	nr := bufio.NewReader(conn)
-	
-	var size [2]byte
+	// edges tell the relay which mountpoints they want, now and
+	// whenever the subscriptions change
+	if req_subs != nil {
+		subs := make(chan []byte, 100)
+		req_subs <- subreq{op: DAVECHAN_PUB, conn: subs}
+
+		defer func() {
+			req_subs <- subreq{op: DAVECHAN_DEL, conn: subs}
+		}()
+
+		go func() {
+			nw := protocol.NewWriter(conn)
+			var err error
+			for b := range subs {
+				if err == nil {
+					err = nw.WriteFrame(b)
+				}
+			}
+		}()
+	}
+
+	nr := protocol.NewReader(conn)
+	received := metric_received.With("tcp:" + addr)
+
 	for {
-		if _, err := io.ReadFull(nr, size[:]); err != nil {
-			return
-		}
-		
-		length := int(size[0])*256 + int(size[1])
-		buff := make([]byte, length)
-		
-		if length == 0 {
-			continue
-		}
+		buff, err := nr.ReadFrame()
 
-		if _, err := io.ReadFull(nr, buff); err != nil {
+		if err != nil {
 			return
 		}
 
+		received.Add(1)
+
 		select {
 		case messages <- buff: // ok
 		default: // blocked
+			metric_dropped.Inc("upstream", "queue full")
 		}
 	}
 }
 
 
-// de-serialise data into datastructure
+// de-serialise data into datastructure - accepts both v1 and v2 headers
 func MakePDU(msg []byte) *davecast {
-	var pdu davecast
+	p, err := protocol.Unmarshal(msg)
 
-	n := len(msg)
-
-	if n < 26 {
+	if err != nil {
+		logit(LOG_DBUG, "bad pdu: %v\n", err)
 		return nil
 	}
 
-	pdu.time = timer_offset()
-	pdu.mtype = int(msg[0])
-	pdu.replica = int(msg[1])
-	pdu.uuid = hex.EncodeToString(msg[2:18])
-	pdu.seq = binary.BigEndian.Uint64(msg[18:26])
+	return NewPDU(p)
+}
 
-	switch msg[0] {
+// the protocol message for a PDU, as needed to check parity - must
+// be called before the PDU is sent downstream and altered
+func (d *davecast) message() *protocol.PDU {
+	uuid, _ := protocol.ParseUUID(d.uuid)
+	return &protocol.PDU{Version: d.version, Type: uint8(d.mtype),
+		Replica: uint8(d.replica), UUID: uuid, Seq: d.seq, Data: d.data,
+		Time: d.pts, Samples: d.samples, Metadata: d.metadata, Codec: d.codec, Mountpoint: d.mountpoint,
+		Headers: d.headers, Group: d.group}
+}
 
-	case DAVECAST_DATA:
-		if n < 28 {
-			return nil
-		}
-		pdu.data = msg[26:n]
+func NewPDU(p *protocol.PDU) *davecast {
+	var pdu davecast
+	pdu.time = timer_offset()
+	pdu.version = p.Version
+	pdu.flags = int(p.Flags)
+	pdu.keyid = p.KeyID
+	pdu.mtype = int(p.Type)
+	pdu.replica = int(p.Replica)
+	pdu.uuid = p.UUID.String()
+	pdu.seq = p.Seq
+	pdu.data = p.Data
+	pdu.pts = p.Time
+	pdu.samples = p.Samples
+	pdu.group = p.Group
+	pdu.metadata = p.Metadata
+	pdu.mountpoint = p.Mountpoint
+	pdu.codec = p.Codec
+	pdu.headers = p.Headers
 
-	case DAVECAST_METADATA:
-		pdu.metadata = string(msg[26:n])
+	return &pdu
+}
 
-	case DAVECAST_ANNOUNCE:
-		if n < 27 {
-			return nil
-		}
-		pdu.mountpoint = string(msg[27:n])
-		pdu.atype = int(msg[26])
+// verify PDU against keyring, if any (owners is nil if not), and
+// de-serialise it, counting the reason for any which are dropped
+func AuthPDU(owners *protocol.Owners, msg []byte, drops map[string]uint64) *davecast {
+	if owners == nil {
+		return MakePDU(msg)
+	}
+
+	p, _, err := owners.Authorize(msg)
 
-	case DAVECAST_HEADERS:
-		pdu.headers = string(msg[26:n])
+	if err != nil {
+		drops[err.Error()]++
+		return nil
 	}
 
-	return &pdu
+	return NewPDU(p)
 }
 
+// log and reset counts of PDUs dropped by AuthPDU
+func log_drops(where string, drops map[string]uint64) {
+	for k, v := range drops {
+		logit(LOG_WARN, "%s dropped %d: %s\n", where, v, k)
+		metric_dropped.Add(int64(v), where, k)
+		delete(drops, k)
+	}
+}
 
-// relay supstream to subscriber and deal with adding and removing them
-func HandleClients(atype int, upstream chan *davecast, dc chan davechan) {
-	cache := davecast{metadata: "", headers: ""}
-	clients := make(map[uint64]chan *davecast)
-	var n uint64 = 0
+// write the upstream audio to the mountpoint's listener buffer and
+// answer listeners' subscriptions with the buffer and latest headers
+func HandleClients(codec protocol.Codec, upstream chan *davecast, dc chan davechan, stat *status.Mountpoint) {
+	cache := davecast{headers: "", codec: codec}
+	buffer := broadcast.New(BufferSize(stat.Name))
 
 	defer func() {
-		for _, v := range clients {
-			close(v)
+		buffer.Close()
+
+		for { // listeners which asked as the mountpoint went away
+			select {
+			case m := <-dc:
+				m.reply <- davechan{op: DAVECHAN_NAK}
+			default:
+				return
+			}
 		}
 	}()
 
 	for {
 		select {
 		case m := <-dc:
-			clients[n] = m.davecast
-			n++
+			pdu := cache
+			m.reply <- davechan{op: DAVECHAN_ACK, buffer: buffer, pdu: &pdu, stat: stat}
 
 		case pdu, ok := <-upstream:
 			if !ok {
 				return
 			}
 			switch pdu.mtype {
-			case DAVECAST_ANNOUNCE:
+			case protocol.ANNOUNCE:
 				cache.mountpoint = pdu.mountpoint
-			case DAVECAST_METADATA:
+			case protocol.METADATA:
 				cache.metadata = pdu.metadata
-			case DAVECAST_HEADERS:
+				buffer.SetMetadata(pdu.metadata.ICYBlock()) // rendered once for all listeners
+				stat.Update(func(m *status.Mountpoint) { m.Metadata = pdu.metadata })
+			case protocol.HEADERS:
 				cache.headers = pdu.headers
+				stat.Update(func(m *status.Mountpoint) { m.Headers = headers(pdu.headers) })
+			case protocol.DATA:
+				buffer.Write(pdu.data)
+				stat.Read(len(pdu.data))
 			}
 
-			// ensure clients always have this info available in 1st PDU
-			pdu.mountpoint = cache.mountpoint
-			pdu.metadata = cache.metadata
-			pdu.headers = cache.headers
-			pdu.atype = atype
-
 			if pdu.seq != cache.seq+1 && pdu.uuid == cache.uuid {
 				// non-contiguous sequence numbers in same stream
 				logit(LOG_CRIT, "/ %s @ %s %v != %v\n", pdu.uuid,
-					pdu.mountpoint, pdu.seq, cache.seq+1)
+					cache.mountpoint, pdu.seq, cache.seq+1)
+				stat.Gap()
 			}
 			cache.seq = pdu.seq
-
-			for k, v := range clients {
-				select {
-				case v <- pdu: //ok
-				default: // buffer full - kill client
-					logit(LOG_CRIT, "| %v lost %v\n", pdu.mountpoint, k)
-					delete(clients, k)
-					close(v)
-				}
-			}
 		}
 	}
 }
@@ -507,8 +1131,7 @@ func MaintainMountpoints(dc chan davechan) {
 
 		case DAVECHAN_SUB:
 			if v, ok := mountpoints[req.key]; ok == true {
-				v.davechan <- davechan{davecast: req.davecast, key: req.key}
-				req.reply <- davechan{op: DAVECHAN_ACK}
+				v.davechan <- req // HandleClients replies
 			} else {
 				req.reply <- davechan{op: DAVECHAN_NAK}
 			}
@@ -517,14 +1140,17 @@ func MaintainMountpoints(dc chan davechan) {
 			logit(LOG_DBUG, "? %s\n", req.key)
 			if _, ok := mountpoints[req.key]; ok == false {
 				logit(LOG_WARN, "+ %s\n", req.key)
+				event_log.Log(events.Event{Event: events.MOUNTPOINT_UP, Mountpoint: req.key})
 				var d stream
-				d.davecast = make(chan *davecast, STREAM_DEPTH)
+				d.davecast = make(chan *davecast, conf().stream_depth)
 				d.davechan = make(chan davechan, 100)
 				d.last = now_minus(0)
+				d.stat = stats.AddMountpoint(req.key, req.codec)
+				d.stat.Update(func(m *status.Mountpoint) { m.Timing = Timing(req.key).status() })
 				mountpoints[req.key] = &d
-				downstrm := make(chan *davecast, STREAM_DEPTH)
+				downstrm := make(chan *davecast, conf().stream_depth)
 
-				go HandleClients(req.atype, downstrm, d.davechan)
+				go HandleClients(req.codec, downstrm, d.davechan, d.stat)
 
 				go func() {
 					defer func() {
@@ -534,9 +1160,10 @@ func MaintainMountpoints(dc chan davechan) {
 						dcs.op = DAVECHAN_DEL
 						dc <- dcs
 						close(downstrm)
+						d.stat.Remove()
 					}()
 
-					HandleMountpoint(req.key, req.atype, d.davecast, downstrm)
+					HandleMountpoint(req.key, req.codec, d.davecast, downstrm, d.stat)
 				}()
 			}
 			dc :=  mountpoints[req.key].davecast
@@ -564,6 +1191,88 @@ func MaintainMountpoints(dc chan davechan) {
 	}
 }
 
+// keeps track of the mountpoints subscribed to and tells relays -
+// also the route by which other messages (NAKs) reach the relays
+func MaintainSubscriptions(req chan subreq, patterns []string) {
+	conns := make(map[chan []byte]bool)
+
+	message := func(op uint8, p []string) []byte {
+		pdu := protocol.PDU{Version: 2, Type: protocol.SUBSCRIBE, Op: op, Patterns: p}
+		b, _ := pdu.Marshal()
+		return b
+	}
+
+	broadcast := func(b []byte) {
+		for c := range conns {
+			select {
+			case c <- b:
+			default:
+			}
+		}
+	}
+
+	for {
+		r := <-req
+
+		switch r.op {
+		case DAVECHAN_PUB: // new relay connection
+			conns[r.conn] = true
+			r.conn <- message(protocol.SUB_ADD, patterns)
+
+		case DAVECHAN_DEL:
+			if _, ok := conns[r.conn]; ok {
+				delete(conns, r.conn)
+				close(r.conn)
+			}
+
+		case DAVECHAN_SUB:
+			var add []string
+			for _, p := range r.patterns {
+				if !contains(patterns, p) && !contains(add, p) {
+					add = append(add, p)
+				}
+			}
+			if len(add) > 0 {
+				logit(LOG_NOTI, "subscribe %v\n", add)
+				patterns = append(patterns, add...)
+				broadcast(message(protocol.SUB_ADD, add))
+			}
+
+		case DAVECHAN_UNS:
+			var del []string
+			keep := []string{}
+			for _, p := range patterns {
+				if contains(r.patterns, p) {
+					del = append(del, p)
+				} else {
+					keep = append(keep, p)
+				}
+			}
+			if len(del) > 0 {
+				logit(LOG_NOTI, "unsubscribe %v\n", del)
+				patterns = keep
+				broadcast(message(protocol.SUB_DEL, del))
+			}
+
+		case DAVECHAN_SND:
+			broadcast(r.msg)
+		}
+
+		if r.reply != nil {
+			r.reply <- append([]string{}, patterns...)
+		}
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
 // rendezvous point for publishing streams
 func MaintainStreams(dc chan davechan) {
 	streams := make(map[string]*stream)
@@ -577,7 +1286,7 @@ func MaintainStreams(dc chan davechan) {
 			if _, ok := streams[req.key]; ok == false {
 				logit(LOG_INFO, "+ %s\n", req.key)
 				var s stream
-				s.davecast = make(chan *davecast, STREAM_DEPTH)
+				s.davecast = make(chan *davecast, conf().stream_depth)
 				s.last = now_minus(0)
 				streams[req.key] = &s
 
@@ -621,70 +1330,204 @@ func HandleStream(uuid string, upstream chan *davecast) {
 
 	last := now_minus(0)
 	ticker := time.NewTicker(time.Second * 1)
+	tries := make(map[uint64]*nak) // NAKs sent for missing sequence numbers
+	parity := make(map[uint64]*davecast) // PARITY PDUs by last seq covered
+	var fec groups // parity groups, if any, to hold off NAKs for
+	recent := make(map[uint64]*protocol.PDU) // sent downstream, for parity
+
+	stat := stats.AddStream(uuid)
+	defer stat.Remove()
+
+	var stalled uint64 // next expected when the stream stalled, for the resync
+
+	var codec protocol.Codec // as announced
+	var stamp *davecast      // last DATA sent downstream, if stamped by the encoder
+
+	// send everything in sequence downstream - as soon as it arrives, so
+	// that the mountpoint sees the frame cadence and can spot a stall
+	forward := func() {
+		for {
+			if pdu, ok := buffer[seq]; ok == true {
+				delete(buffer, seq)
+				delete(recent, seq-protocol.MAX_GROUP)
+				seq++
+
+				// parity may not arrive until after its group is
+				// sent, so keep them for any stream which may have it
+				if pdu.version >= 2 {
+					recent[pdu.seq] = pdu.message()
+				}
+
+				if pdu.mtype == protocol.ANNOUNCE {
+					
+					if downstream == nil {
+						dcs := davechan{key: pdu.mountpoint,
+						codec: pdu.codec, op: DAVECHAN_PUB}
+						dcs.reply = make(chan davechan, 100)
+						req_mounts <- dcs
+						r := <-dcs.reply
+						downstream = r.davecast
+
+						event_log.Log(events.Event{Event: events.STREAM_UP,
+							Mountpoint: pdu.mountpoint, UUID: uuid,
+							Replica: events.Replica(pdu.replica)})
+					}
+
+					mountpoint = pdu.mountpoint
+					codec = pdu.codec
+				}
+
+				if pdu.mtype == protocol.DATA {
+					// parity doesn't cover the header, so a frame rebuilt
+					// from it is stamped following on from the last
+					if pdu.pts == 0 && stamp != nil && codec.FrameSamples() > 0 {
+						pdu.samples = stamp.samples + uint64(codec.FrameSamples())
+						pdu.pts = stamp.pts + int64(codec.FrameDuration())
+					}
+
+					stamp = nil
+					if pdu.pts != 0 {
+						stamp = pdu
+					}
+				}
+
+				if downstream != nil {
+					pdu.mountpoint = mountpoint
+					pdu.upstream = nil
+
+					select {
+					case downstream <- pdu: // ok
+						last = now_minus(0)
+					default: // blocked
+						logit(LOG_CRIT, "| %v @ %v\n", uuid, upstream)
+						event_log.Log(events.Event{Event: events.STREAM_DETACHED,
+							Mountpoint: mountpoint, UUID: uuid, Reason: "mountpoint blocked"})
+						downstream = nil
+					}
+				}
+			} else {
+				break
+			}
+		}
+	}
+
+	var recovered, gaps, requested int // since the stats were last updated
+
+	// ask the relays for anything still missing once a gap is found -
+	// and, on streams with parity, could not be rebuilt from it
+	request := func() {
+		if seq != 0 && len(buffer) > 0 {
+			g, r := RequestMissing(uuid, seq, buffer, tries, fec)
+			gaps += g
+			requested += r
+		}
+	}
+
+	// rebuild what is missing from the buffer from parity - as soon as
+	// a gap or the parity to fill it arrives, so that one lost datagram
+	// does not hold up forward() until the next tick
+	repair := func() {
+		if seq != 0 && len(parity) > 0 && len(buffer) > 0 {
+			recovered += RecoverMissing(uuid, seq, buffer, parity, recent)
+			forward()
+		}
+	}
 
 	for {
 		select {
 		case <-ticker.C:
-			if last < now_minus(DEAD_TIME) {
+			t := Timing(mountpoint) // may change with the config file
+
+			if last < now_minus(seconds(t.dead)) {
 				logit(LOG_INFO, "< %v\n", uuid)
+				event_log.Log(events.Event{Event: events.STREAM_DOWN, Mountpoint: mountpoint,
+					UUID: uuid, Reason: "expired"})
 				return
 			}
 
-			if seq != 0 && last < now_minus(SYNC_TIME) {
+			if seq != 0 && last < now_minus(seconds(t.sync)) {
 				logit(LOG_INFO, "* %v\n", uuid)
+				stalled = seq
+				stat.Update(func(s *status.Stream) { s.Resyncs++ })
+				metric_resyncs.Inc(mountpoint)
 				seq = 0
 				last = now_minus(0)
+				tries = make(map[uint64]*nak)
+				parity = make(map[uint64]*davecast)
+				fec = groups{}
+				recent = make(map[uint64]*protocol.PDU)
+				stamp = nil
 				break
 			}
 
-			if seq != 0 && last < now_minus(BLIP_TIME) {
+			if seq != 0 && last < now_minus(seconds(t.blip)) {
 				logit(LOG_INFO, "%% %v < %v\n", uuid, mountpoint)
 			}
 
-			for {
-				if pdu, ok := buffer[seq]; ok == true {
-					delete(buffer, seq)
-					seq++
-
-					if pdu.mtype == DAVECAST_ANNOUNCE {
-						
-						if downstream == nil {
-							dcs := davechan{key: pdu.mountpoint,
-							atype: pdu.atype, op: DAVECHAN_PUB}
-							dcs.reply = make(chan davechan, 100)
-							req_mounts <- dcs
-							r := <-dcs.reply
-							downstream = r.davecast
-						}
+			// also drops parity for groups since sent
+			if seq != 0 && len(parity) > 0 {
+				recovered += RecoverMissing(uuid, seq, buffer, parity, recent)
+				forward()
+			}
 
-						mountpoint = pdu.mountpoint
-					}
+			request()
+
+			stat.Update(func(s *status.Stream) {
+				s.Mountpoint = mountpoint
+				s.Seq = seq
+				s.Reorder = len(buffer)
+				s.Gaps += uint64(gaps)
+				s.Requested += uint64(requested)
+				s.Recovered += uint64(recovered)
+			})
+
+			if downstream != nil {
+				metric_gaps.Add(int64(gaps), mountpoint)
+				metric_requested.Add(int64(requested), mountpoint)
+				metric_recovered.Add(int64(recovered), mountpoint)
+			}
 
-					if downstream != nil {
-						pdu.mountpoint = mountpoint
-						pdu.upstream = nil
+			recovered, gaps, requested = 0, 0, 0
 
-						select {
-						case downstream <- pdu: // ok
-							last = now_minus(0)
-						default: // blocked
-							logit(LOG_CRIT, "| %v @ %v\n", uuid, upstream)
-							downstream = nil
-						}
-					}
-				} else {
-					break
-				}
+		case pdu, ok := <-upstream:
+			if !ok {
+				logit(LOG_INFO, "< %v\n", uuid)
+				event_log.Log(events.Event{Event: events.STREAM_DOWN, Mountpoint: mountpoint,
+					UUID: uuid, Reason: "upstream closed"})
+				return
 			}
 
-		case pdu := <-upstream:
 			if pdu.uuid != uuid {
 				logit(LOG_INFO, "! %v != %v\n", pdu.uuid, uuid)
 				break
 			}
 
+			// parity shares the sequence number of the last PDU covered
+			if pdu.mtype == protocol.PARITY {
+				if pdu.seq > fec.last && len(pdu.group) > 0 {
+					fec = groups{last: pdu.seq, size: uint64(len(pdu.group))}
+				}
+				if seq != 0 && pdu.seq >= seq && pdu.seq < (seq+1000) {
+					parity[pdu.seq] = pdu
+					repair()
+					request() // for any its group closed on
+				}
+				break
+			}
+
 			if seq == 0 {
 				logit(LOG_INFO, "= %v\n", uuid)
+
+				if stalled != 0 {
+					ev := events.Event{Event: events.RESYNC, Mountpoint: mountpoint,
+						UUID: uuid, Replica: events.Replica(pdu.replica), Reason: "stalled"}
+					if pdu.seq > stalled {
+						ev.Gap = pdu.seq - stalled
+					}
+					event_log.Log(ev)
+					stalled = 0
+				}
+
 				seq = pdu.seq
 				buffer = make(map[uint64]*davecast)
 				last = now_minus(0)
@@ -692,21 +1535,150 @@ func HandleStream(uuid string, upstream chan *davecast) {
 
 			if pdu.seq >= seq && pdu.seq < (seq+1000) {
 				buffer[pdu.seq] = pdu
+				forward()
+				repair()
+				request()
 			}
 
 		}
 	}
 }
 
+// rebuild PDUs missing from a stream's reorder buffer from parity
+// PDUs whose groups are otherwise complete, returning the number
+func RecoverMissing(uuid string, seq uint64, buffer map[uint64]*davecast, parity map[uint64]*davecast, recent map[uint64]*protocol.PDU) int {
+	var n int
+
+	for k, p := range parity {
+		if k < seq { // group already sent downstream
+			delete(parity, k)
+			continue
+		}
+
+		var lost []uint64
+		var others []*protocol.PDU
+
+		for _, s := range p.group {
+			if d, ok := buffer[s]; ok {
+				others = append(others, d.message())
+			} else if m, ok := recent[s]; ok {
+				others = append(others, m)
+			} else {
+				lost = append(lost, s)
+			}
+		}
+
+		if len(lost) == 0 {
+			delete(parity, k)
+		}
+
+		if len(lost) != 1 || lost[0] < seq {
+			continue
+		}
+
+		m, err := protocol.Recover(p.message(), others)
+
+		if err != nil {
+			logit(LOG_DBUG, "bad parity: %v\n", err)
+			delete(parity, k)
+			continue
+		}
+
+		logit(LOG_INFO, "& %v %v\n", uuid, m.Seq)
+
+		pdu := NewPDU(m)
+		pdu.keyid = p.keyid
+		buffer[m.Seq] = pdu
+		delete(parity, k)
+		n++
+	}
+
+	return n
+}
+
+// ask the relays to resend PDUs missing from a stream's reorder
+// buffer (between seq, the next expected, and the latest received)
+// which have not been asked for within NAK_RETRY, and whose parity
+// group has closed, returning the number newly found missing and the
+// number requested
+func RequestMissing(uuid string, seq uint64, buffer map[uint64]*davecast, tries map[uint64]*nak, fec groups) (int, int) {
+	var top uint64
+
+	for k := range buffer {
+		if k > top {
+			top = k
+		}
+	}
+
+	for k := range tries {
+		if k < seq {
+			delete(tries, k)
+		}
+	}
+
+	var missing []uint64
+	var gaps int
+
+	now := timer_offset()
+
+	for s := seq; s < top && len(missing) < protocol.MAX_NAK; s++ {
+		if _, ok := buffer[s]; ok || fec.open(s, top) {
+			continue
+		}
+
+		n, ok := tries[s]
+
+		if !ok {
+			n = &nak{}
+			tries[s] = n
+			gaps++
+		} else if n.tries >= NAK_TRIES || time.Duration(now-n.last) < NAK_RETRY {
+			continue
+		}
+
+		n.tries++
+		n.last = now
+		missing = append(missing, s)
+	}
+
+	if len(missing) == 0 || req_subs == nil {
+		return gaps, 0
+	}
+
+	u, err := protocol.ParseUUID(uuid)
+	if err != nil {
+		return gaps, 0
+	}
+
+	pdu := protocol.PDU{Version: 2, Type: protocol.NAK, UUID: u, Missing: missing}
+
+	if b, err := pdu.Marshal(); err == nil {
+		logit(LOG_INFO, "? %v %v\n", uuid, missing)
+		req_subs <- subreq{op: DAVECHAN_SND, msg: b}
+	}
+
+	return gaps, len(missing)
+}
+
 func PDURouter(upstream chan []byte) {
 
 	streams := make(map[string]*stream)
 	ticker := time.NewTicker(time.Second * 5)
+	drops := make(map[string]uint64)
+
+	var owners *protocol.Owners // streams are bound to the key which announced them
+	if keys != nil {
+		owners = protocol.NewOwners(keys)
+	}
 
 	for {
 		select {
 		case <-ticker.C:
-			then := now_minus(DEAD_TIME)
+			then := now_minus(seconds(conf().timing.dead))
+
+			if owners != nil {
+				owners.Expire(time.Now().Add(-conf().timing.dead))
+			}
 
 			for k, v := range streams {
 				if v.last < then {
@@ -714,17 +1686,23 @@ func PDURouter(upstream chan []byte) {
 				}
 			}
 
-		case msg := <-upstream:
-			pdu := MakePDU(msg)
+			log_drops("edge", drops)
+
+		case msg, ok := <-upstream:
+			if !ok {
+				return
+			}
+
+			pdu := AuthPDU(owners, msg, drops)
 
 			if pdu == nil {
 				logit(LOG_DBUG, "nil pdu\n")
 				continue
 			}
 
-			if pdu.mtype == DAVECAST_ANNOUNCE {
+			if pdu.mtype == protocol.ANNOUNCE {
 				if _, ok := streams[pdu.uuid]; ok == false {
-					dcs := davechan{key: pdu.uuid, atype: pdu.atype,
+					dcs := davechan{key: pdu.uuid, codec: pdu.codec,
 					op: DAVECHAN_PUB}
 					dcs.reply = make(chan davechan, 1000)
 					req_stream <- dcs
@@ -735,7 +1713,7 @@ func PDURouter(upstream chan []byte) {
 			}
 
 			if stream, ok := streams[pdu.uuid]; ok == true {
-				if pdu.mtype == DAVECAST_ANNOUNCE {
+				if pdu.mtype == protocol.ANNOUNCE {
 					stream.last = now_minus(0)
 				}
 
@@ -743,6 +1721,7 @@ func PDURouter(upstream chan []byte) {
 				case stream.davecast <- pdu: // ok
 				default: // blocked
 					logit(LOG_CRIT, "| %s\n", pdu.uuid)
+					metric_dropped.Inc("edge", "stream queue full")
 					delete(streams, pdu.uuid)
 				}
 			}
@@ -750,58 +1729,263 @@ func PDURouter(upstream chan []byte) {
 	}
 }
 
-func Replay(r *ring.Ring, t nanosec, tmp chan *davecast, up chan *davecast) {
-	hit := false
-	for v, ok := r.Shift(); ok; v, ok = r.Shift() {
-		if v.(*davecast).time > t && !hit {
-			hit = true
+// send a backup stream's buffered PDUs from the at'th (or if at is -1,
+// those received after time t), then switch back to reading upstream -
+// logs the failover event, timed when it happened, once the replay is
+// done and the offset into the buffer and number replayed are known
+func Replay(r *ring.Ring, t nanosec, at int, tmp chan *davecast, up chan *davecast, ev events.Event) {
+	hit := at >= 0
+	for ; at > 0; at-- {
+		r.Shift()
+		ev.Offset++
+	}
+	for v, ok := r.Shift(); ok; v, ok = r.Shift() {
+		if v.(*davecast).time > t && !hit {
+			hit = true
+			ev.Offset++
+			continue
+		}
+		if hit {
+			tmp <- v.(*davecast)
+			ev.Replayed++
+		} else {
+			ev.Offset++
+		}
+	}
+	event_log.Log(ev)
+	tmp <- &davecast{mtype: DAVECAST_CONTROL, upstream: up}
+}
+
+// where to start replaying a backup's buffered PDUs by the encoders'
+// timestamps - the first frame starting at least half a frame after
+// the last one sent, as the encoders' frames need not line up - or -1
+// if either stream is not stamped or this is more than SPLICE_SKEW
+// from where arrival times would start it (eg. the encoders' clocks
+// are out of step). A backup which is behind starts after its buffer,
+// HandleMountpoint dropping its frames until it catches up (or for
+// SPLICE_SKEW, by when it should have).
+func TimestampPoint(r *ring.Ring, last *davecast, frame time.Duration) (int, string) {
+	if last.pts == 0 {
+		return -1, ""
+	}
+
+	arrival := r.Items() // as Replay would start by arrival time
+	for n := 0; n < r.Items(); n++ {
+		if r.At(n).(*davecast).time > last.time {
+			arrival = n
+			break
+		}
+	}
+
+	within := r.Items()
+	if frame > 0 {
+		within = int(SPLICE_SKEW / frame)
+	}
+
+	point := func(n int) (int, string) {
+		if n < arrival-within || n > arrival+within {
+			return -1, ""
+		}
+		if n > r.Items() {
+			n = r.Items()
+		}
+		return n, splice.TIMESTAMP
+	}
+
+	var newest *davecast
+
+	for n := 0; n < r.Items(); n++ {
+		d := r.At(n).(*davecast)
+		switch {
+		case d.mtype != protocol.DATA:
+			continue
+		case d.pts == 0:
+			return -1, ""
+		case d.pts > last.pts+int64(frame/2):
+			return point(n)
+		}
+		newest = d
+	}
+
+	// the backup is behind - by how much, if the frame rate is known
+	n := r.Items()
+	if newest != nil && frame > 0 {
+		n += int(time.Duration(last.pts-newest.pts) / frame)
+	}
+
+	return point(n)
+}
+
+// whether d was captured after p - by the encoders' timestamps where
+// both are stamped, or else by when they arrived
+func (d *davecast) after(p *davecast) bool {
+	if d.pts != 0 && p.pts != 0 {
+		return d.pts > p.pts
+	}
+	return d.time > p.time
+}
+
+// where to start replaying a backup's buffered PDUs so that it carries
+// on from the frames last sent, and how they were matched - or -1 if
+// they could not be
+func SplicePoint(sent *ring.Ring, r *ring.Ring, last *davecast, frame time.Duration) (int, string) {
+	var frames, backup [][]byte
+	var index []int // of each of backup in r
+	var near int
+
+	for n := 0; n < sent.Items(); n++ {
+		frames = append(frames, sent.At(n).([]byte))
+	}
+
+	for n := 0; n < r.Items(); n++ {
+		d := r.At(n).(*davecast)
+		if d.mtype != protocol.DATA {
 			continue
 		}
-		if hit {
-			tmp <- v.(*davecast)
+		if !d.after(last) {
+			near = len(backup) + 1
 		}
+		backup = append(backup, d.data)
+		index = append(index, n)
 	}
-	tmp <- &davecast{mtype: DAVECAST_CONTROL, upstream: up}
+
+	within := len(backup)
+	if frame > 0 {
+		within = int(SPLICE_SKEW / frame)
+	}
+
+	i, how := splice.Find(frames, backup, near, within)
+	if i < 0 {
+		return -1, ""
+	}
+
+	return index[i-1] + 1, how // anything after the last frame matched
 }
 
 // add quality score to incoming pdus - switch streams based on quality?
-func HandleMountpoint(mp string, atype int, in chan *davecast, out chan *davecast) {
+func HandleMountpoint(mp string, codec protocol.Codec, in chan *davecast, out chan *davecast, stat *status.Mountpoint) {
 
 	state := davecast{time: 0, last: 0, seq: 0, uuid: ""}
 	ticker := time.NewTicker(time.Second * 1)
 	buffers := make(map[string]*ring.Ring)
 
+	frame := codec.FrameDuration()  // 0 if unknown - no early failover
+	sent := ring.New(splice.FRAMES) // last frames sent to listeners, to match backups to
+	forwarded := timer_offset()     // when the active stream last reached listeners
+	quiet := func() time.Duration { return time.Duration(timer_offset() - forwarded) }
+
+	// checks for a stall each time one could have happened since the
+	// last frame - only waking when it is due, not for every frame
+	check := time.NewTimer(stall(Timing(mp), frame))
+	defer check.Stop()
+
 	noncontig := false
+	var resume int64   // frames of a backup stamped before this were already sent
+	var until nanosec  // when to stop dropping them, caught up or not
+	var dropped uint64 // PDUs of the active stream dropped since state.seq
+
+	down := func(reason string) {
+		event_log.Log(events.Event{Event: events.MOUNTPOINT_DOWN, Mountpoint: mp,
+			UUID: state.uuid, Reason: reason})
+	}
 
 	for {
 		select {
 		case <-ticker.C:
+			t := Timing(mp) // may change with the config file
+
 			for k, r := range buffers {
-				if r.Peek().(*davecast).last+FAIL_TIME < state.last {
+				if r.Peek().(*davecast).time+nanosec(t.fail) < forwarded {
 					delete(buffers, k)
 				}
 			}
-			if state.last < now_minus(FAIL_TIME) {
+
+			stat.Update(func(m *status.Mountpoint) {
+				m.Backups = m.Backups[:0]
+				for k, r := range buffers {
+					m.Backups = append(m.Backups, status.Backup{UUID: k, Depth: r.Items()})
+				}
+				sort.Slice(m.Backups, func(i, j int) bool { return m.Backups[i].UUID < m.Backups[j].UUID })
+				m.Timing = t.status()
+			})
+
+			if quiet() > t.fail {
+				down("stalled")
 				return
 			}
 
-			if state.last > now_minus(int64(BLIP_TIME)) {
+		case <-check.C:
+			t := Timing(mp)
+			wait := stall(t, frame)
+			q := quiet()
+
+			if q < wait {
+				check.Reset(wait - q)
+				break
+			}
+
+			// before blip only fail over to a backup which is ready,
+			// otherwise the active stream may yet be the best bet
+			var k string
+			var r *ring.Ring
+
+			for uuid, b := range buffers {
+				if q >= t.blip || ready(b, &state, frame) {
+					k, r = uuid, b
+					break
+				}
+			}
+
+			if r == nil && q < t.blip {
+				if frame < t.blip-q {
+					check.Reset(frame)
+				} else {
+					check.Reset(t.blip - q)
+				}
 				break
 			}
 
 			logit(LOG_NOTI, "~ %s @ %s\n", state.uuid, mp)
 			state.seq = 0
 
-			for k, r := range buffers {
-				tmp := make(chan *davecast, STREAM_DEPTH)
-				go Replay(r, state.time, tmp, in)
-				in = tmp
-				delete(buffers, k)
+			if r == nil {
+				check.Reset(time.Second)
 				break
 			}
 
+			stat.Update(func(m *status.Mountpoint) {
+				now := time.Now()
+				m.Failovers++
+				m.LastFailover = &now
+			})
+			metric_failovers.Inc(mp)
+
+			ev := events.Event{Time: time.Now(), Event: events.FAILOVER, Mountpoint: mp,
+				UUID: k, From: state.uuid, Reason: "stalled"}
+
+			at := -1
+			if Splice(mp) {
+				at, ev.Splice = SplicePoint(sent, r, &state, frame)
+			}
+			if at < 0 {
+				at, ev.Splice = TimestampPoint(r, &state, frame)
+			}
+
+			resume, dropped = 0, 0
+			if ev.Splice == splice.TIMESTAMP {
+				resume = state.pts + int64(frame/2)
+				until = timer_offset() + nanosec(SPLICE_SKEW)
+			}
+
+			tmp := make(chan *davecast, conf().stream_depth)
+			go Replay(r, state.time, at, tmp, in, ev)
+			in = tmp
+			delete(buffers, k)
+			check.Reset(wait)
+
 		case pdu, ok := <-in:
 			if !ok {
+				down("upstream closed")
 				return
 			}
 
@@ -813,11 +1997,11 @@ func HandleMountpoint(mp string, atype int, in chan *davecast, out chan *davecas
 			if state.seq == 0 {
 				state.uuid = pdu.uuid
 				state.seq = pdu.seq
+				dropped = 0
 				logit(LOG_INFO, "= %s @ %s\n", state.uuid, mp)
+				stat.Update(func(m *status.Mountpoint) { m.Active = state.uuid })
 			}
 
-			pdu.last = now_minus(0)
-			
 			if pdu.uuid != state.uuid {
 				if r, ok := buffers[pdu.uuid]; ok == false {
 					buffers[pdu.uuid] = ring.New(1000) // create buffer
@@ -832,7 +2016,7 @@ func HandleMountpoint(mp string, atype int, in chan *davecast, out chan *davecas
 				break
 			}
 
-			if pdu.seq != state.seq {
+			if pdu.seq != state.seq+dropped {
 				// shouldn't happen - should be ordered
 				if !noncontig {
 					logit(LOG_CRIT, "! %v %v %v\n", pdu.seq, state.seq, mp)
@@ -843,20 +2027,66 @@ func HandleMountpoint(mp string, atype int, in chan *davecast, out chan *davecas
 
 			noncontig = false
 
+			// drop the frames of a backup which was behind, rather than
+			// repeat them, until it catches up with the last one sent -
+			// as none reach listeners the stream may still stall
+			if resume != 0 && pdu.mtype == protocol.DATA {
+				if pdu.pts != 0 && pdu.pts <= resume && timer_offset() < until {
+					dropped++
+					break
+				}
+				resume = 0
+			}
+
 			select {
 			case out <- pdu:
 			default:
 				logit(LOG_WARN, "- %s\n", mp)
+				down("listeners blocked")
 				return
 			}
 
+			if pdu.mtype == protocol.DATA {
+				sent.Push(pdu.data)
+				state.pts = pdu.pts
+			}
+
 			state.time = pdu.time
-			state.last = now_minus(0)
-			state.seq++
+			forwarded = timer_offset()
+			state.seq += dropped + 1
+			dropped = 0
 		}
 	}
 }
 
+// how long the active stream may go without a frame before failing
+// over: the stall time (no less than STALL_FRAMES frames) if set and
+// the frame rate is known, or else blip
+func stall(t timing, frame time.Duration) time.Duration {
+	if t.stall == 0 || frame == 0 {
+		return t.blip
+	}
+
+	wait := t.stall
+	if wait < STALL_FRAMES*frame {
+		wait = STALL_FRAMES * frame
+	}
+
+	if wait > t.blip {
+		return t.blip
+	}
+
+	return wait
+}
+
+// a backup which carries on from where the active stream stopped
+// and is still arriving at the frame rate
+func ready(r *ring.Ring, active *davecast, frame time.Duration) bool {
+	d := r.Peek().(*davecast)
+	return frame > 0 && d.after(active) &&
+		time.Duration(timer_offset()-d.time) <= STALL_FRAMES*frame
+}
+
 var start time.Time
 
 func timer_start() {
@@ -878,71 +2108,410 @@ func now_minus(minus int64) sec {
 	return sec(time.Now().Unix() - minus)
 }
 
+// whole seconds, for now_minus
+func seconds(d time.Duration) int64 {
+	return int64(d / time.Second)
+}
+
 
 //////////////////////////////////////////////////////////////////////
 // Stuff from here down is only for relays and should be split out
 //////////////////////////////////////////////////////////////////////
 
-func RelayMain() {
-	var n uint64 = 0
-	channel := make(chan []byte, 10000)
-	control := make(chan chan []byte, 100)
-	clients := make(map[uint64]chan []byte)
-	producer := "8001"
-	consumer := "9001"
+// maximum number of relays a PDU may traverse
+const MAX_HOPS = 8
+
+// PDUs kept per stream for retransmission to edges which NAK them -
+// ~6s of a 40pps stream, after which the edge will have failed over
+const RETRANSMIT = 256
+
+// sequence numbers remembered per stream to detect duplicate PDUs -
+// ~25s of a 40pps stream, longer than any path should take
+const WINDOW = 1024
+
+// recently seen sequence numbers for a stream, as a bitmap of the
+// WINDOW sequence numbers up to and including top
+type window struct {
+	top  uint64
+	bits [WINDOW / 64]uint64
+	init bool
+	last sec
+}
+
+// check returns true if seq has not been seen before, and records it.
+// PDUs older than the window are assumed to be duplicates.
+func (w *window) check(seq uint64) bool {
+	w.last = now_minus(0)
+
+	if !w.init || seq > w.top+WINDOW {
+		w.init = true
+		w.top = seq
+		w.bits = [WINDOW / 64]uint64{}
+	}
+
+	for ; w.top < seq; w.top++ { // slide window forwards
+		n := (w.top + 1) % WINDOW
+		w.bits[n/64] &^= 1 << (n % 64)
+	}
+
+	if seq+WINDOW <= w.top {
+		return false
+	}
+
+	n := seq % WINDOW
+	bit := uint64(1) << (n % 64)
+
+	if w.bits[n/64]&bit != 0 {
+		return false
+	}
+
+	w.bits[n/64] |= bit
+	return true
+}
+
+// recently relayed PDUs for a stream, indexed by sequence number
+type backlog struct {
+	seqs [RETRANSMIT]uint64
+	pdus [RETRANSMIT][]byte
+	last sec
+}
+
+func (b *backlog) store(seq uint64, pdu []byte) {
+	b.seqs[seq%RETRANSMIT] = seq
+	b.pdus[seq%RETRANSMIT] = pdu
+	b.last = now_minus(0)
+}
+
+func (b *backlog) fetch(seq uint64) []byte {
+	if b.pdus[seq%RETRANSMIT] == nil || b.seqs[seq%RETRANSMIT] != seq {
+		return nil
+	}
+	return b.pdus[seq%RETRANSMIT]
+}
+
+// relay client state - owned by RelayMain
+type relay_client struct {
+	name     string // remote address or multicast group
+	feed     chan []byte
+	patterns []string               // nil until the client subscribes
+	matched  map[protocol.UUID]bool // cache of stream uuids matched
+}
+
+// subscription change from a relay client
+type subscription struct {
+	client   *relay_client
+	op       uint8
+	patterns []string
+}
+
+// retransmission request from a relay client
+type retransmit struct {
+	client  *relay_client
+	uuid    protocol.UUID
+	missing []uint64
+}
+
+// mountpoint for a stream uuid, as seen in announcements
+type relay_mount struct {
+	name string
+	last sec
+}
+
+// should a PDU for this stream uuid be sent to the client?
+func (c *relay_client) wants(uuid protocol.UUID, mounts map[protocol.UUID]*relay_mount) bool {
+	if c.patterns == nil {
+		return true // client has not asked for a subset
+	}
+
+	if m, ok := c.matched[uuid]; ok {
+		return m
+	}
+
+	mp, ok := mounts[uuid]
+
+	if !ok {
+		return false // not announced yet - edge would ignore it anyway
+	}
 
-	if len(os.Args) > 2 {
-		consumer = os.Args[2]
+	m := protocol.Match(c.patterns, mp.name)
+	c.matched[uuid] = m
+	return m
+}
+
+func (c *relay_client) subscribe(op uint8, patterns []string) {
+	if c.patterns == nil {
+		c.patterns = []string{}
 	}
 
-	if len(os.Args) > 3 {
-		producer = os.Args[3]
+	for _, p := range patterns {
+		i := 0
+		for ; i < len(c.patterns) && c.patterns[i] != p; i++ {
+		}
+
+		switch {
+		case op == protocol.SUB_ADD && i == len(c.patterns):
+			c.patterns = append(c.patterns, p)
+		case op == protocol.SUB_DEL && i < len(c.patterns):
+			c.patterns = append(c.patterns[:i], c.patterns[i+1:]...)
+		}
 	}
 
-	go TCPServer(producer, control) // for TCPClient instances to connect to
+	c.matched = make(map[protocol.UUID]bool)
+}
+
+func RelayMain(base *settings, file string) {
+	var n uint64 = 0
+	channel := make(chan []byte, 10000)
+	control := make(chan *relay_client, 100)
+	subs := make(chan subscription, 100)
+	naks := make(chan retransmit, 100)
+	clients := make(map[uint64]*relay_client)
+	mounts := make(map[protocol.UUID]*relay_mount)
+	producer := conf().clients
+	consumer := conf().sources
+
+	go TCPServer(producer, control, subs, naks) // for TCPClient instances to connect to
 	go TCPRecv(consumer, channel) // for sources to push TCP streams to
 	go UDPRecv(consumer, channel) // for sources to push UDP streams to
 
-	if len(os.Args) > 4 {
-		if strings.Contains(os.Args[4], "@") {
-			go McastRecv(strings.Replace(os.Args[4], "@", ":", 1), channel)
+	// upstream relays (TCP) or multicast groups (host@port, with an
+	// optional interface to receive on, eg. "ff15::1@9000,if=eth1")
+	connect := func(addr string, done chan struct{}) {
+		if strings.Contains(addr, "@") {
+			group, opts, _ := multicast(addr) // checked with the settings
+			McastRecv(group, opts, channel, done)
 		} else {
-			go TCPClient(os.Args[4], channel)
+			TCPClient(addr, channel, done)
 		}
 	}
 
+	connected := upstreams{}
+	connected.update(conf().upstreams, connect)
+
+	if file != "" {
+		reload(base, file, true, func(old, s *settings) {
+			if s.sources != old.sources || s.clients != old.clients ||
+				strings.Join(s.multicast, " ") != strings.Join(old.multicast, " ") {
+				logit(LOG_WARN, "ports and multicast groups need a restart to change\n")
+			}
+
+			connected.update(s.upstreams, connect)
+		})
+	}
+
+	// metrics for scraping, eg. METRICS=:9100
+	if addr := os.Getenv("METRICS"); addr != "" {
+		http.HandleFunc("/metrics", metrics.Handler)
+		go func() { log.Fatal(http.ListenAndServe(addr, nil)) }()
+	}
+
+	// multicast groups to relay everything to (MULTICAST)
+	for _, g := range conf().multicast {
+		addr, opts, _ := multicast(g)
+		go McastSend(addr, opts, control)
+	}
+
 	var x uint64 = 0
+	ticker := time.NewTicker(time.Second * 5)
+	drops := make(map[string]uint64)
+	seen := make(map[protocol.UUID]*window)
+	fec := make(map[protocol.UUID]*window) // PARITY seen, see below
+	history := make(map[protocol.UUID]*backlog)
+
+	var owners *protocol.Owners // streams are bound to the key which announced them
+	if keys != nil {
+		owners = protocol.NewOwners(keys)
+	}
 
 	for {
 		select {
+		case <-ticker.C:
+			log_drops("relay", drops)
+
+			metric_relay_clients.Set(int64(len(clients)))
+			metric_relay_queue.Reset()
+			for _, c := range clients {
+				metric_relay_queue.Set(int64(len(c.feed)), c.name)
+			}
+
+			for k, w := range seen {
+				if w.last < now_minus(seconds(conf().timing.dead)) {
+					delete(seen, k)
+				}
+			}
+
+			for k, w := range fec {
+				if w.last < now_minus(seconds(conf().timing.dead)) {
+					delete(fec, k)
+				}
+			}
+
+			for k, b := range history {
+				if b.last < now_minus(seconds(conf().timing.dead)) {
+					delete(history, k)
+				}
+			}
+
+			if owners != nil {
+				owners.Expire(time.Now().Add(-conf().timing.dead))
+			}
+
+			for k, v := range mounts {
+				if v.last < now_minus(seconds(conf().timing.dead)) {
+					delete(mounts, k)
+					for _, c := range clients {
+						delete(c.matched, k)
+					}
+				}
+			}
+
 		case c := <-control: // new client
 			clients[n] = c
 			n++
 
-		case pdu := <-channel: // new pdu to relay
-			if len(pdu) > 0 {
-				for k, v := range clients {
-					x++
-					if x%1000 == 0 && float64(len(v)) > float64(cap(v))*0.9 {
-						logit(LOG_DBUG, "%d ~> %d\n", len(v), cap(v))
+		case s := <-subs: // client subscription change
+			s.client.subscribe(s.op, s.patterns)
+			logit(LOG_INFO, "subscribed: %v\n", s.client.patterns)
+
+		case r := <-naks: // client missed some PDUs
+			b, ok := history[r.uuid]
+			if !ok {
+				break
+			}
+
+			for k, c := range clients {
+				if c != r.client {
+					continue
+				}
+
+				sent := 0
+			resend:
+				for _, seq := range r.missing {
+					if pdu := b.fetch(seq); pdu != nil {
+						select {
+						case c.feed <- pdu: // ok
+							sent++
+						default: // blocked
+							logit(LOG_DBUG, "blocked!")
+							metric_dropped.Inc("relay", "client queue full")
+							event_log.Log(events.Event{Event: events.CLIENT_KILL,
+								Client: c.name, Reason: "queue full"})
+							close(c.feed)
+							delete(clients, k)
+							break resend
+						}
 					}
+				}
 
-					select {
-					case v <- pdu: // ok
-					default: // blocked
-						logit(LOG_DBUG, "blocked!")
-						close(v)
-						delete(clients, k)
+				logit(LOG_INFO, "resent %d/%d %v\n", sent, len(r.missing), r.uuid)
+			}
+
+		case pdu := <-channel: // new pdu to relay
+			if owners != nil {
+				if _, _, err := owners.Authorize(pdu); err != nil {
+					drops[err.Error()]++
+					continue
+				}
+			}
+
+			p, err := protocol.Unmarshal(pdu)
+
+			if err != nil {
+				drops[err.Error()]++
+				continue
+			}
+
+			// the same PDU may arrive by several paths (replicas from
+			// the encoder, other relays) - only forward it once. PARITY
+			// PDUs take the sequence number of the last DATA covered.
+			dedupe := seen
+			if p.Type == protocol.PARITY {
+				dedupe = fec
+			}
+
+			w, ok := dedupe[p.UUID]
+			if !ok {
+				w = &window{}
+				dedupe[p.UUID] = w
+			}
+
+			if !w.check(p.Seq) {
+				continue
+			}
+
+			// relays feeding each other would otherwise loop forever
+			if pdu, ok = protocol.Hop(pdu, MAX_HOPS); !ok {
+				drops["hop limit exceeded"]++
+				continue
+			}
+
+			h, ok := history[p.UUID]
+			if !ok {
+				h = &backlog{}
+				history[p.UUID] = h
+			}
+
+			if p.Type != protocol.PARITY {
+				h.store(p.Seq, pdu)
+			}
+
+			if p.Type == protocol.ANNOUNCE {
+				if m, ok := mounts[p.UUID]; !ok || m.name != p.Mountpoint {
+					mounts[p.UUID] = &relay_mount{name: p.Mountpoint}
+					for _, c := range clients {
+						delete(c.matched, p.UUID)
 					}
 				}
+				mounts[p.UUID].last = now_minus(0)
+			}
+
+			for k, c := range clients {
+				if !c.wants(p.UUID, mounts) {
+					continue
+				}
+
+				v := c.feed
+				x++
+				if x%1000 == 0 && float64(len(v)) > float64(cap(v))*0.9 {
+					logit(LOG_DBUG, "%d ~> %d\n", len(v), cap(v))
+				}
+
+				select {
+				case v <- pdu: // ok
+				default: // blocked
+					logit(LOG_DBUG, "blocked!")
+					metric_dropped.Inc("relay", "client queue full")
+					event_log.Log(events.Event{Event: events.CLIENT_KILL,
+						Client: c.name, Reason: "queue full"})
+					close(v)
+					delete(clients, k)
+				}
 			}
 		}
 	}
 }
 
+// parse "group@port,option=value,..." giving "group:port"
+func multicast(arg string) (string, mcast.Options, error) {
+	fields := strings.Split(arg, ",")
+	opts := mcast.Defaults
+
+	for _, o := range fields[1:] {
+		kv := strings.SplitN(o, "=", 2)
+		if len(kv) != 2 {
+			return "", opts, errors.New("bad multicast option " + o)
+		}
+		if err := opts.Set(kv[0], kv[1]); err != nil {
+			return "", opts, err
+		}
+	}
+
+	return mcast.HostPort(fields[0]), opts, nil
+}
+
 // Relay stuff - accept connections from sources
 func TCPRecv(p string, ch chan []byte) {
-	l, err := net.Listen("tcp", "0.0.0.0:"+p)
+	l, err := transport.Listen("tcp", ":"+p, transport.Defaults) // IPv4 and IPv6
 	if err != nil {
 		logit(LOG_CRIT, "Error listening:", err.Error())
 		os.Exit(1)
@@ -951,30 +2520,26 @@ func TCPRecv(p string, ch chan []byte) {
 	// Close the listener when the application closes
 	defer l.Close()
 
-	logit(LOG_INFO, "TCP", "0.0.0.0:"+p)
+	logit(LOG_INFO, "TCP", ":"+p)
 
 	for {
 		// Listen for an incoming connection
 		if conn, err := l.Accept(); err != nil {
 			logit(LOG_WARN, "Error accepting: ", err.Error())
 		} else {
-			go func(conn net.Conn, ch chan []byte) {
+			go func(conn *transport.Conn, ch chan []byte) {
 				defer conn.Close()
-				nr := bufio.NewReader(conn)
+				nr := protocol.NewReader(conn)
+				received := metric_received.With("tcp:" + p)
 
 				for {
-					var size [2]byte
-					if _, err := io.ReadFull(nr, size[:]); err != nil {
-						return
-					}
-					
-					buff := make([]byte, int(size[0])*256 + int(size[1]))
-					
-					if _, err := io.ReadFull(nr, buff); err != nil {
+					buff, err := nr.ReadFrame()
+
+					if err != nil {
 						return
 					}
+					received.Add(1)
 					ch <- buff
-
 				}
 			}(conn, ch)
 		}
@@ -982,9 +2547,13 @@ func TCPRecv(p string, ch chan []byte) {
 }
 
 // Relay stuff 	- redistribute messages to clients
-func TCPServer(port string, control chan chan []byte) {
+func TCPServer(port string, control chan *relay_client, subs chan subscription, naks chan retransmit) {
+
+	// edges only write to change their subscriptions
+	config := transport.Defaults
+	config.ReadTimeout = 0
 
-	l, err := net.Listen("tcp", "0.0.0.0:"+port)
+	l, err := transport.Listen("tcp", ":"+port, config)
 	if err != nil {
 		logit(LOG_CRIT, "Error listening:", err.Error())
 		os.Exit(1)
@@ -1001,22 +2570,41 @@ func TCPServer(port string, control chan chan []byte) {
 
 				// 100000 ~ 5sec * 230 streams * 2 feeds (~40pps)
 				feed := make(chan []byte, 100000)
-				control <- feed
+				client := &relay_client{name: conn.RemoteAddr().String(), feed: feed}
+				control <- client
+				nw := protocol.NewWriter(conn)
+
+				// clients may send subscription and retransmission
+				// requests
+				go func() {
+					nr := protocol.NewReader(conn)
+					for {
+						b, err := nr.ReadFrame()
+						if err != nil {
+							return
+						}
+						p, err := protocol.Unmarshal(b)
+						if err != nil {
+							continue
+						}
+						switch p.Type {
+						case protocol.SUBSCRIBE:
+							subs <- subscription{client, p.Op, p.Patterns}
+						case protocol.NAK:
+							naks <- retransmit{client, p.UUID, p.Missing}
+						}
+					}
+				}()
 
 				for {
 					if o, ok := <-feed; !ok {
 						return
 					} else {
-						l := len(o)
-						b := make([]byte, l+2)
-						b[0] = byte(l >> 8)
-						b[1] = byte(l % 256)
-						copy(b[2:], o[:])
-
-						if n, err := conn.Write(b); n != l+2 || err != nil {
-							logit(LOG_INFO, "Error writing: %v", err.Error())
+						if err := nw.WriteFrame(o); err != nil {
+							logit(LOG_INFO, "Error writing: %v", err)
 							return
 						}
+						metric_relay_bytes.Add(int64(len(o)))
 					}
 				}
 			}()
@@ -1024,35 +2612,59 @@ func TCPServer(port string, control chan chan []byte) {
 	}
 }
 
-// Relay stuff
-func McastRecv(p string, ch chan []byte) {
-	addr, err := net.ResolveUDPAddr("udp", p)
-	if err != nil {
-		logit(LOG_CRIT, "Error resolving:", err.Error())
-		os.Exit(1)
+// Relay stuff - receive from a multicast group until done is closed,
+// joining it again if that fails (eg. the interface is not yet up)
+func McastRecv(p string, opts mcast.Options, ch chan []byte, done chan struct{}) {
+	for {
+		McastSession(p, opts, ch, done)
+
+		select {
+		case <-done:
+			return
+		case <-time.After(10 * time.Second):
+		}
 	}
+}
 
+func McastSession(p string, opts mcast.Options, ch chan []byte, done chan struct{}) {
 	// Listen for incoming connections
-	l, err := net.ListenMulticastUDP("udp", nil, addr)
+	l, err := mcast.Listen(p, opts)
 	if err != nil {
-		logit(LOG_CRIT, "Error listening:", err.Error())
-		os.Exit(1)
+		logit(LOG_CRIT, "Error listening: %v\n", err)
+		return
 	}
 
-	l.SetReadBuffer(9000)
+	l.SetReadBuffer(1 << 20) // relays and encoders send in bursts
 
-	// Close the listener when the application closes
-	defer l.Close()
+	closed := make(chan struct{})
+	defer close(closed)
+
+	// leaves the group, and ends the loop below
+	go func() {
+		select {
+		case <-done:
+		case <-closed:
+		}
+		l.Close()
+	}()
 
 	logit(LOG_INFO, "MDC", p)
 
 	buf := make([]byte, 9000)
+	received := metric_received.With("mcast:" + p)
 
 	for {
 		if n, _, err := l.ReadFromUDP(buf); err != nil {
-			logit(LOG_WARN, "Error receiving: ", err.Error())
+			select {
+			case <-done:
+				return
+			default:
+			}
+			logit(LOG_WARN, "Error receiving: %v\n", err)
+			return // and join again
 		} else {
 			//fmt.Printf("!")
+			received.Add(1)
 			pdu := make([]byte, n)
 			copy(pdu, buf)
 			ch <- pdu
@@ -1060,8 +2672,33 @@ func McastRecv(p string, ch chan []byte) {
 	}
 }
 
+// Relay stuff - send everything relayed to a multicast group
+func McastSend(addr string, opts mcast.Options, control chan *relay_client) {
+	conn, err := mcast.Dial(addr, opts)
+	if err != nil {
+		logit(LOG_CRIT, "Error connecting: %v\n", err)
+		os.Exit(1)
+	}
+
+	defer conn.Close()
+
+	logit(LOG_INFO, "MDC send %s ttl %d\n", addr, opts.TTL)
+
+	for {
+		feed := make(chan []byte, 100000)
+		control <- &relay_client{name: "mcast:" + addr, feed: feed}
+
+		for b := range feed {
+			conn.Write(b) // nobody listening is not an error
+			metric_relay_bytes.Add(int64(len(b)))
+		}
+
+		logit(LOG_WARN, "multicast %s blocked\n", addr)
+	}
+}
+
 func UDPRecv(p string, ch chan []byte) {
-	addr, err := net.ResolveUDPAddr("udp", "0.0.0.0:"+p)
+	addr, err := net.ResolveUDPAddr("udp", ":"+p)
 	if err != nil {
 		logit(LOG_CRIT, "Error resolving:", err.Error())
 		os.Exit(1)
@@ -1077,14 +2714,16 @@ func UDPRecv(p string, ch chan []byte) {
 	// Close the listener when the application closes
 	defer l.Close()
 
-	logit(LOG_INFO, "UDP", "0.0.0.0:"+p)
+	logit(LOG_INFO, "UDP", ":"+p)
 
 	buf := make([]byte, 9000)
+	received := metric_received.With("udp:" + p)
 
 	for {
 		if n, _, err := l.ReadFromUDP(buf); err != nil {
 			logit(LOG_WARN, "Error receiving: ", err.Error())
 		} else {
+			received.Add(1)
 			pdu := make([]byte, n)
 			copy(pdu, buf)
 			ch <- pdu
@@ -0,0 +1,434 @@
+package main
+
+import (
+	"config" // included
+	"encoding/json"
+	"events"   // included
+	"protocol" // included
+	"ring"     // included
+	"splice"   // included
+	"testing"
+	"time"
+)
+
+func defaults() settings {
+	return settings{listen: "8000", timing: timing{blip: BLIP_TIME * time.Second,
+		fail: FAIL_TIME * time.Second, sync: SYNC_TIME * time.Second, dead: DEAD_TIME * time.Second}}
+}
+
+func TestTiming(t *testing.T) {
+	ms := func(n int) config.Duration { return config.Duration(time.Duration(n) * time.Millisecond) }
+
+	s := defaults()
+	c := &config.Config{Mountpoints: []config.Mountpoint{
+		{Match: "Talk*", Timing: config.Timing{Blip: ms(3000), Fail: ms(5000), Stall: ms(500)}},
+		{Match: "TalkSport", Timing: config.Timing{Blip: ms(2000)}},
+	}}
+
+	if err := s.apply(c, false); err != nil {
+		t.Fatal(err)
+	}
+
+	current.Store(&s)
+
+	if s.timing != defaults().timing {
+		t.Errorf("defaults changed by overrides: %+v", s.timing)
+	}
+
+	for _, x := range []struct {
+		mountpoint string
+		want       timing
+	}{
+		{"Capital", defaults().timing},
+		{"TalkRadio", timing{blip: 3 * time.Second, fail: 5 * time.Second, stall: 500 * time.Millisecond,
+			sync: SYNC_TIME * time.Second, dead: DEAD_TIME * time.Second}},
+		// named exactly, so taken over the pattern listed before it
+		{"TalkSport", timing{blip: 2 * time.Second, fail: FAIL_TIME * time.Second,
+			sync: SYNC_TIME * time.Second, dead: DEAD_TIME * time.Second}},
+	} {
+		if got := Timing(x.mountpoint); got != x.want {
+			t.Errorf("%s: got %+v, want %+v", x.mountpoint, got, x.want)
+		}
+	}
+
+	s = defaults()
+	c.Mountpoints[1].Timing.Sync = ms(500)
+
+	if err := s.apply(c, false); err == nil {
+		t.Error("sync under a second accepted")
+	}
+}
+
+func TestBurst(t *testing.T) {
+	s := defaults()
+	current.Store(&s)
+
+	for _, x := range []struct {
+		burst   config.Burst
+		bitrate uint32
+		want    int
+	}{
+		{config.Burst{Bytes: 1000}, 128000, 1000},
+		{config.Burst{Bytes: 1000}, 0, 1000},
+		{config.Burst{Time: 4 * time.Second}, 128000, 64000},
+		{config.Burst{Time: 4 * time.Second}, 0, BURST_SIZE}, // bitrate not announced
+		{config.Burst{}, 0, 0},                               // disabled
+	} {
+		s.burst = x.burst
+
+		if got := burst("Capital", protocol.Codec{Bitrate: x.bitrate}); got != x.want {
+			t.Errorf("%+v at %d: got %d, want %d", x.burst, x.bitrate, got, x.want)
+		}
+	}
+}
+
+func TestStall(t *testing.T) {
+	ms := time.Millisecond
+	frame := 23 * ms // 44.1k AAC
+
+	for _, x := range []struct {
+		stall, blip, frame, want time.Duration
+	}{
+		{0, 6000 * ms, frame, 6000 * ms},         // not set
+		{500 * ms, 6000 * ms, 0, 6000 * ms},      // frame rate unknown
+		{500 * ms, 6000 * ms, frame, 500 * ms},   // as set
+		{10 * ms, 6000 * ms, frame, 4 * frame},   // no less than STALL_FRAMES
+		{8000 * ms, 6000 * ms, frame, 6000 * ms}, // no more than blip
+		{10 * ms, 50 * ms, frame, 50 * ms},       // even if STALL_FRAMES is longer
+	} {
+		if got := stall(timing{stall: x.stall, blip: x.blip}, x.frame); got != x.want {
+			t.Errorf("stall %v blip %v frame %v: got %v, want %v", x.stall, x.blip, x.frame, got, x.want)
+		}
+	}
+}
+
+func TestReady(t *testing.T) {
+	timer_start()
+	frame := 23 * time.Millisecond
+	now := timer_offset()
+	ago := func(n int) nanosec { return now - nanosec(time.Duration(n)*frame) }
+
+	active := &davecast{time: ago(10)}
+
+	for _, x := range []struct {
+		name   string
+		backup davecast
+		frame  time.Duration
+		want   bool
+	}{
+		{"arriving", davecast{time: ago(1)}, frame, true},
+		{"frame rate unknown", davecast{time: ago(1)}, 0, false},
+		{"behind the active stream", davecast{time: ago(11)}, frame, false},
+		{"stalled itself", davecast{time: ago(STALL_FRAMES + 2)}, frame, false},
+		// by the encoders' clocks when both are stamped
+		{"stamped ahead", davecast{time: ago(1), pts: 2000}, frame, true},
+		{"stamped behind", davecast{time: ago(1), pts: 500}, frame, false},
+	} {
+		r := ring.New(4)
+		r.Push(&x.backup)
+
+		a := *active
+		if x.backup.pts != 0 {
+			a.pts = 1000
+		}
+
+		if got := ready(r, &a, x.frame); got != x.want {
+			t.Errorf("%s: got %v", x.name, got)
+		}
+	}
+}
+
+func TestTimestampPoint(t *testing.T) {
+	frame := 500 * time.Millisecond // SPLICE_SKEW is 6 frames
+	F := int64(frame)
+	base := time.Now().UnixNano()
+
+	for _, x := range []struct {
+		name     string
+		pts      int64 // of the last frame sent, from the backup's first
+		arrival  int   // where arrival times would start the backup
+		unsigned bool  // backup not stamped
+		want     int
+	}{
+		{"ahead", 4*F + 1, 3, false, 5},
+		{"not stamped", 4*F + 1, 3, true, -1},
+		{"ahead beyond skew", -F, 9, false, -1},
+		{"behind", 11 * F, 9, false, 10}, // skip all buffered
+		{"behind beyond skew", 19 * F, 9, false, -1},
+	} {
+		r := ring.New(10)
+		for n := 0; n < 10; n++ {
+			d := &davecast{mtype: protocol.DATA, time: nanosec(n * 100), pts: base + int64(n)*F}
+			if x.unsigned {
+				d.pts = 0
+			}
+			r.Push(d)
+		}
+
+		last := &davecast{time: nanosec(x.arrival*100 - 50), pts: base + x.pts}
+
+		if got, _ := TimestampPoint(r, last, frame); got != x.want {
+			t.Errorf("%s: got %d, want %d", x.name, got, x.want)
+		}
+	}
+}
+
+func TestRequestMissing(t *testing.T) {
+	timer_start()
+	req_subs = make(chan subreq, NAK_TRIES+1)
+	defer func() { req_subs = nil }()
+
+	uuid := "0123456789abcdef0123456789abcdef"
+	buffer := map[uint64]*davecast{12: {}, 14: {}}
+	tries := make(map[uint64]*nak)
+
+	expect := func(gaps, requested int) {
+		t.Helper()
+		if g, r := RequestMissing(uuid, 10, buffer, tries, groups{}); g != gaps || r != requested {
+			t.Errorf("got %d gaps, %d requested, want %d, %d", g, r, gaps, requested)
+		}
+	}
+
+	expect(3, 3) // 10, 11 and 13 as soon as they are seen missing
+	expect(0, 0) // not again until NAK_RETRY has passed
+
+	for i := 1; i < NAK_TRIES; i++ {
+		for _, n := range tries {
+			n.last -= nanosec(NAK_RETRY)
+		}
+		expect(0, 3)
+	}
+
+	for _, n := range tries {
+		n.last -= nanosec(NAK_RETRY)
+	}
+	expect(0, 0) // given up on
+
+	if len(req_subs) != NAK_TRIES {
+		t.Errorf("%d NAKs sent", len(req_subs))
+	}
+}
+
+func TestRequestMissingParity(t *testing.T) {
+	timer_start()
+	req_subs = make(chan subreq, 10)
+	defer func() { req_subs = nil }()
+
+	uuid := "0123456789abcdef0123456789abcdef"
+	buffer := map[uint64]*davecast{10: {}, 11: {}, 13: {}}
+	tries := make(map[uint64]*nak)
+	fec := groups{last: 9, size: 4} // groups of 10-13, 14-17, ...
+
+	expect := func(seq uint64, gaps, requested int) {
+		t.Helper()
+		if g, r := RequestMissing(uuid, seq, buffer, tries, fec); g != gaps || r != requested {
+			t.Errorf("got %d gaps, %d requested, want %d, %d", g, r, gaps, requested)
+		}
+	}
+
+	expect(10, 0, 0) // 12 may yet be rebuilt from the parity for 10-13
+
+	// as it is, once the parity arrives
+	buffer[12] = &davecast{}
+	fec.last = 13
+	buffer[14] = &davecast{}
+	expect(10, 0, 0)
+
+	// 16 isn't, and the group closes with 18 arriving
+	buffer[15] = &davecast{}
+	buffer[17] = &davecast{}
+	expect(14, 0, 0)
+	buffer[18] = &davecast{}
+	expect(14, 1, 1)
+
+	if len(req_subs) != 1 || len(tries) != 1 || tries[16] == nil {
+		t.Errorf("%d NAKs sent for %v", len(req_subs), tries)
+	}
+}
+
+// events as they are logged
+type logged chan events.Event
+
+func (l logged) Write(b []byte) (int, error) {
+	var e events.Event
+	err := json.Unmarshal(b, &e)
+	l <- e
+	return len(b), err
+}
+
+func (l logged) next(t *testing.T) events.Event {
+	t.Helper()
+	select {
+	case e := <-l:
+		return e
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event logged")
+	}
+	return events.Event{}
+}
+
+func TestReplayEvent(t *testing.T) {
+	l := make(logged, 10)
+	event_log = events.New(l)
+	defer func() { event_log = nil }()
+
+	when := time.Now().Add(-time.Minute).Round(0)
+
+	for _, x := range []struct {
+		at               int
+		offset, replayed int
+	}{
+		{-1, 3, 2}, // skips those until the first after the active stream's last
+		{1, 1, 4},
+	} {
+		r := ring.New(10)
+		for n := 1; n <= 5; n++ {
+			r.Push(&davecast{mtype: protocol.DATA, seq: uint64(n), time: nanosec(n)})
+		}
+
+		tmp := make(chan *davecast, 10)
+		Replay(r, 2, x.at, tmp, nil, events.Event{Time: when, Event: events.FAILOVER})
+
+		e := l.next(t)
+
+		if e.Offset != x.offset || e.Replayed != x.replayed || !e.Time.Equal(when) {
+			t.Errorf("at %d: got %+v", x.at, e)
+		}
+
+		if len(tmp) != x.replayed+1 {
+			t.Errorf("at %d: %d sent", x.at, len(tmp))
+		}
+	}
+}
+
+func TestResyncEvent(t *testing.T) {
+	timer_start()
+	l := make(logged, 10)
+	event_log = events.New(l)
+	defer func() { event_log = nil }()
+
+	s := defaults()
+	s.timing.sync = time.Second
+	current.Store(&s)
+
+	req_mounts = make(chan davechan, 1)
+	defer func() { req_mounts = nil }()
+
+	go func() {
+		r := <-req_mounts
+		r.reply <- davechan{davecast: make(chan *davecast, 100)}
+	}()
+
+	uuid := "0123456789abcdef0123456789abcdef"
+	upstream := make(chan *davecast, 10)
+	done := make(chan struct{})
+
+	go func() {
+		HandleStream(uuid, upstream)
+		close(done)
+	}()
+
+	// stopped before the globals it uses are reset
+	defer func() {
+		close(upstream)
+		<-done
+	}()
+
+	pdu := func(mtype int, seq uint64) *davecast {
+		return &davecast{uuid: uuid, mtype: mtype, seq: seq, mountpoint: "Resync", replica: 1}
+	}
+
+	upstream <- pdu(protocol.ANNOUNCE, 1)
+	upstream <- pdu(protocol.DATA, 2)
+	upstream <- pdu(protocol.DATA, 3)
+
+	if e := l.next(t); e.Event != events.STREAM_UP {
+		t.Fatalf("got %+v", e)
+	}
+
+	// stalled, expecting 4
+	for n := 0; ; n++ {
+		_, streams := stats.Mountpoints()
+		if s := streams["Resync"]; len(s) == 1 && s[0].Resyncs == 1 {
+			break
+		}
+		if n == 50 {
+			t.Fatal("not resynced")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	upstream <- pdu(protocol.DATA, 10)
+
+	e := l.next(t)
+
+	if e.Event != events.RESYNC || e.Gap != 6 || e.UUID != uuid || e.Replica == nil || *e.Replica != 1 {
+		t.Errorf("got %+v", e)
+	}
+}
+
+func TestResume(t *testing.T) {
+	timer_start()
+	l := make(logged, 10)
+	event_log = events.New(l)
+	defer func() { event_log = nil }()
+
+	s := defaults()
+	s.timing.blip = 200 * time.Millisecond
+	current.Store(&s)
+
+	codec := protocol.Codec{Codec: protocol.CODEC_AAC, Profile: protocol.PROFILE_AAC_LC, SampleRate: 48000}
+	F := int64(codec.FrameDuration())
+	base := time.Now().UnixNano()
+
+	in := make(chan *davecast, 20)
+	out := make(chan *davecast, 20)
+	done := make(chan struct{})
+
+	go func() {
+		HandleMountpoint("Resume", codec, in, out, stats.AddMountpoint("Resume", codec))
+		close(done)
+	}()
+
+	// the backup was captured three frames behind the active stream
+	pdu := func(uuid string, seq uint64, pts int64) *davecast {
+		return &davecast{uuid: uuid, mtype: protocol.DATA, seq: seq, pts: base + pts*F, time: timer_offset()}
+	}
+
+	for n := 1; n <= 5; n++ {
+		in <- pdu("active", uint64(n), int64(n))
+	}
+
+	for n := 1; n <= 5; n++ {
+		in <- pdu("backup", uint64(n), int64(n-3))
+	}
+
+	if e := l.next(t); e.Event != events.FAILOVER || e.Splice != splice.TIMESTAMP || e.Replayed != 0 {
+		t.Fatalf("got %+v", e)
+	}
+
+	// frames up to the last sent are dropped, the stream carrying on
+	// with those after
+	for n := 6; n <= 10; n++ {
+		in <- pdu("backup", uint64(n), int64(n-3))
+	}
+
+	close(in)
+	<-done
+
+	var got []uint64
+	for len(out) > 0 {
+		d := <-out
+		if d.uuid == "backup" {
+			got = append(got, d.seq)
+		}
+	}
+
+	if len(got) != 2 || got[0] != 9 || got[1] != 10 {
+		t.Errorf("got %v from the backup", got)
+	}
+
+	if e := l.next(t); e.Event != events.MOUNTPOINT_DOWN || e.Reason != "upstream closed" {
+		t.Errorf("got %+v", e)
+	}
+}
@@ -24,101 +24,74 @@ import (
     "strconv"
 	"io"
 	"time"
-	"net"
 	"strings"
-	"encoding/hex"
-    "encoding/binary"
-	"crypto/rand"
+
+	"adts"
+	"protocol"
+	"source"
 )
 
-const DAVECAST_DATA     = 0
-const DAVECAST_METADATA = 1
-const DAVECAST_ANNOUNCE = 2
-const DAVECAST_HEADERS  = 3
-const DAVECAST_CACHE    = 254
-const DAVECAST_DONE     = 255
-
-const ADTS_AAC_2C_44100_48000  = 0
-const ADTS_MP3_2C_44100_128000 = 1
-const ADTS_AAC_2C_44100_192000 = 2
-const ADTS_AAC_2C_44100_128000 = 3
-const ADTS_MP3_1C_44100_48000  = 4
-const ADTS_AAC_2C_44100_24000  = 5
-
-type nanosec int64
-type davecast struct {
-	time nanosec
-
-	mtype int
-	replica int
-	uuid string
-	seq uint64
-
-	data []byte
-	mountpoint string
-	metadata string
-	atype int
-
-    headers string
-}
+var relays *source.Relays
 
-type relay struct {
-	channel chan []byte
-}
+func main () {
+	var args source.Settings
 
-var relays []relay
-var seq uint64 = 0
+	if len(os.Args) > 2 {
+		args = source.Settings{Server: os.Args[1], Stream: os.Args[2],
+			Destinations: os.Args[3:]}
+	}
 
-func main () {
-	server := os.Args[1]
-	stream := os.Args[2]
-	
-	for n := 3; n < len(os.Args); n++ {
-		var r relay
-		r.channel = make(chan []byte, 1000)
-		relays = append(relays, r)
-		if strings.Contains(os.Args[n], "@") {
-			go udp_client(strings.Replace(os.Args[n], "@", ":", 1), r.channel)
-		} else {
-			go tcp_client(os.Args[n], r.channel)
-		}
+	// server, stream and destinations in the file take precedence
+	s, err := source.Load(args)
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	dc := make(chan davecast, 1000)
-	go http_client(server, stream, dc)
+	if s.Server == "" || s.Stream == "" {
+		log.Fatal("server and stream must be given")
+	}
+
+	if relays, err = source.NewRelays(1000); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := relays.Update(s.Destinations); err != nil {
+		log.Fatal(err)
+	}
+
+	// destinations may be changed by reloading the file (SIGHUP)
+	source.Reload(args, func(n source.Settings) {
+		s.WarnRestart(n)
+		if err := relays.Update(n.Destinations); err != nil {
+			log.Println(s.Stream, "destinations not changed:", err)
+		}
+	})
+
+	dc := make(chan protocol.PDU, 1000)
+	go http_client(s.Server, s.Stream, dc)
 
 	for {
 		select {
 		case <-time.After(time.Second * 30):
-			log.Println(stream, "timeout")
+			log.Println(s.Stream, "timeout")
 			return
-			
+
 		case pdu := <- dc:
-			
-			pdu.seq = seq
-			seq++
-			
-			for n := 0; n < len(relays); n++ {
-				pdu.replica = n
-				select {
-				case relays[n].channel <- pdu_to_bytes(pdu):
-				default:
-				}
-			}
+			relays.Send(pdu)
 		}
 	}
 }
 
-func http_client (server string, stream string, dc chan davecast) {
-	uuid, _ := new_uuid()
+func http_client (server string, stream string, dc chan protocol.PDU) {
+	uuid, _ := protocol.NewUUID()
 	
-	source := fmt.Sprintf("http://%s/%s", server, stream)
+	endpoint := fmt.Sprintf("http://%s/%s", server, stream)
 
 	client := &http.Client{
 		//CheckRedirect: redirectPolicyFunc,
 	}
 
-	req, err := http.NewRequest("GET", source, nil)
+	req, err := http.NewRequest("GET", endpoint, nil)
 	req.Header.Add("Icy-MetaData", "1")
 	resp, err := client.Do(req)
 
@@ -142,82 +115,56 @@ func http_client (server string, stream string, dc chan davecast) {
 	}
 
 
-	mtype := "UNK"
-	ice_ainfo := ""
-
-	var pdu davecast
-	pdu.mountpoint = stream
-	pdu.uuid = string(uuid)
-	pdu.atype = ADTS_AAC_2C_44100_48000
-	
+	var pdu protocol.PDU
+	pdu.Mountpoint = stream
+	pdu.UUID = uuid
+	pdu.Codec = protocol.LegacyCodec(protocol.MP3_2C_44100_128000)
 
 	if header, ok := resp.Header["Content-Type"]; ok {
 		
 		switch header[0] {
 		case "audio/aac":
-			mtype = "AAC"
+			pdu.Codec = protocol.LegacyCodec(protocol.AAC_2C_44100_48000)
 			
-		case "audio/aacp":
-			mtype = "AAC"
+		case "audio/aacp": // often AAC-LC - HE-AAC only if the frames show it
+			pdu.Codec = protocol.LegacyCodec(protocol.AAC_2C_44100_48000)
 			
 		case "audio/mpeg":
-			mtype = "MP3"
+			pdu.Codec = protocol.LegacyCodec(protocol.MP3_2C_44100_128000)
 		}
 	}
 	
+	var ice protocol.Codec // as given by Ice-Audio-Info, to spot HE-AAC
+
 	if ice_info, ok := resp.Header["Ice-Audio-Info"]; ok {
 		info := strings.Split(ice_info[0], ";")
 
-		ice_samplerate := 44100
-		ice_bitrate := 48
-		ice_channels := 2
-		
-
 		for _, v := range info {
 			param := strings.Split(v, "=")
-			//log.Println(k, v)
+			if len(param) != 2 {
+				continue
+			}
 			p, _ := strconv.Atoi(param[1])
 			
 			switch param[0] {
 			case "ice-samplerate":
-				ice_samplerate = p
+				pdu.Codec.SampleRate = uint32(p)
+				ice.SampleRate = uint32(p)
 				
 			case "ice-bitrate":
-				ice_bitrate = p
+				pdu.Codec.Bitrate = uint32(p) * 1000
 				
 			case "ice-channels":
-				ice_channels = p
+				pdu.Codec.Channels = uint8(p)
+				ice.Channels = uint8(p)
 			}
 		}
-
-		ice_ainfo = fmt.Sprintf("ADTS_%s_%dC_%d_%d000", mtype, ice_channels, ice_samplerate, ice_bitrate)
 	}
 
-	log.Println(ice_ainfo, stream, uuid)
+	log.Println(pdu.Codec, stream, uuid)
 
-	switch ice_ainfo {
-	case "ADTS_AAC_2C_44100_48000":
-		pdu.atype = ADTS_AAC_2C_44100_48000
-		
-	case "ADTS_MP3_2C_44100_128000":
-		pdu.atype = ADTS_MP3_2C_44100_128000
-		
-	case "ADTS_AAC_2C_44100_192000":
-		pdu.atype = ADTS_AAC_2C_44100_192000
-		
-	case "ADTS_AAC_2C_44100_128000":
-		pdu.atype = ADTS_AAC_2C_44100_128000
-
-	case "ADTS_MP3_1C_44100_48000":
-		pdu.atype = ADTS_MP3_1C_44100_48000
-
-	case "ADTS_AAC_2C_44100_24000":
-		pdu.atype = ADTS_AAC_2C_44100_24000
-		
-	default:
-		log.Println("OOPS", ice_ainfo, stream)
-		pdu.atype = ADTS_MP3_2C_44100_128000
-		//return
+	if relays.Version == 1 && !pdu.Codec.HasLegacy() {
+		log.Println("OOPS", pdu.Codec, stream, "has no v1 audio type - use PROTOCOL=2")
 	}
 
 
@@ -229,11 +176,14 @@ func http_client (server string, stream string, dc chan davecast) {
 			headers = append(headers,  fmt.Sprintf("%s\r%s", k, v[0]))
 		}
 	}
-	pdu.headers = strings.Join(headers, "\n")
+	pdu.Headers = strings.Join(headers, "\n")
 	
-	var adts [65536]byte
+	var raw [65536]byte
 	var last byte = 0x00
 	offs := 0
+	var samples uint64 // position of the next frame in the stream, for its timestamp
+	var clock source.Clock
+	probed := pdu.Codec.Codec != protocol.CODEC_AAC // only the first frame, for HE-AAC
 
 	for {
 		
@@ -245,15 +195,15 @@ func http_client (server string, stream string, dc chan davecast) {
 		}
 
 		for n := 0; n < len(buff); n++ {
-			adts[offs] = buff[n]
+			raw[offs] = buff[n]
 			
 			if last == 0xff && buff[n] & 0xf0 == 0xf0 {
 				
 				switch offs {
 
 				case 0: // shouldn't happen ... make it more palatable
-					adts[0] = last
-					adts[1] = buff[n]
+					raw[0] = last
+					raw[1] = buff[n]
 					offs = 2
 
 				case 1:
@@ -261,12 +211,29 @@ func http_client (server string, stream string, dc chan davecast) {
 				default:
 					size := offs - 1
 					var tmp = make([]byte, size)
-					copy(tmp[:], adts[0:size])
-					pdu.data = tmp
-					adts[0] = last
-					adts[1] = buff[n]
+					copy(tmp[:], raw[0:size])
+					pdu.Data = tmp
+					raw[0] = last
+					raw[1] = buff[n]
 					offs = 2
-					pdu.mtype = DAVECAST_DATA
+					pdu.Type = protocol.DATA
+
+					// before it is announced or its frames counted
+					if !probed {
+						var probe adts.Probe
+						probe.Add(tmp)
+						if c := source.Probed(probe.Info(), ice); c.Codec == protocol.CODEC_AAC &&
+							c.Profile != pdu.Codec.Profile {
+							log.Println(stream, "frames are", c)
+							pdu.Codec.Profile, pdu.Codec.SampleRate, pdu.Codec.Channels =
+								c.Profile, c.SampleRate, c.Channels
+						}
+						probed = true
+					}
+
+					pdu.Time = clock.Stamp(time.Now().UnixNano(), samples, pdu.Codec) // only sent with PROTOCOL=2
+					pdu.Samples = samples
+					samples += uint64(pdu.Codec.FrameSamples())
 					dc <- pdu
 					last = 0x00
 					if( size > 1024) {
@@ -281,7 +248,7 @@ func http_client (server string, stream string, dc chan davecast) {
 			}
 		}
 		
-	    pdu.mtype = DAVECAST_ANNOUNCE
+	    pdu.Type = protocol.ANNOUNCE
 		dc <- pdu
 		
 		// read 1 byte
@@ -299,11 +266,11 @@ func http_client (server string, stream string, dc chan davecast) {
 		}
 		//log.Println("meta: ", nread, string(meta[0:msiz]))
 
-        pdu.mtype = DAVECAST_METADATA
-        pdu.metadata = string(meta)
+        pdu.Type = protocol.METADATA
+        pdu.Metadata = protocol.ParseICY(meta)
 		dc <- pdu
 
-        pdu.mtype = DAVECAST_HEADERS
+        pdu.Type = protocol.HEADERS
 		dc <- pdu
 	}
 }
@@ -335,154 +302,3 @@ func readall(reader io.ReadCloser, p []byte, n int) (int){
 
 	return done
 }
-
-
-
-
-
-
-
-
-
-
-
-
-
-func udp_client(addr string, messages chan []byte) {
-
-	dst, err := net.ResolveUDPAddr("udp", addr)
-	if err != nil {
-        log.Println("Error resolving:", err.Error())
-        os.Exit(1)
-	}
-
-	defer func() {
-		time.Sleep(3000 * time.Millisecond)
-		go udp_client(addr, messages)
-    }();
-	
-	// connect to this socket
-	conn, err := net.DialUDP("udp", nil, dst)
-	
-    if err != nil {
-		return
-    }
-	
-	defer func() {
-		//log.Printf("udp closing: %s\n", addr);
-		conn.Close();
-	}();
-	
-	log.Printf("udp opened: %s\n", addr);
-	
-	for {
-		buff := <- messages
-		_, err := conn.Write(buff)
-		if err != nil {
-			//log.Println("Error writing:", n, err.Error())
-			return
-		}
-	}
-}
-
-func tcp_client(addr string, messages chan []byte) {
-
-	defer func() {
-		time.Sleep(3000 * time.Millisecond)
-		go tcp_client(addr, messages)
-    }();
-	
-	// connect to this socket
-	conn, err := net.Dial("tcp", addr)
-	
-    if err != nil {
-		return
-    }
-	
-	defer func() {
-		log.Printf("tcp closing: %s\n", addr);
-		conn.Close();
-	}();
-	
-	log.Printf("tcp opened: %s\n", addr);
-	
-	for {
-		buff := <- messages
-		y := len(buff)
-
-		var size [2]byte
-		size[0] = byte(y >> 8)
-		size[1] = byte(y % 256)
-		
-		conn.Write(size[0:2])
-		n, err := conn.Write(buff)
-		
-		if n != y {
-			log.Println("Error writing:", n, y)
-		}
-		
-		if err != nil {
-			log.Println("Error writing:", n, err.Error())
-			return
-		}
-	}
-}
-
-func pdu_to_bytes (pdu davecast) ([]byte) {
-	size := 26
-
-	switch pdu.mtype {
-	case DAVECAST_DATA:
-		size += len(pdu.data)
-	case DAVECAST_METADATA:
-		size +=len(pdu.metadata)
-	case DAVECAST_ANNOUNCE:
-		size += (1+len(pdu.mountpoint))
-	case DAVECAST_HEADERS:
-		size += len(pdu.headers)
-	}
-
-	buff := make([]byte, size)
-	
-	buff[0] = byte(pdu.mtype)
-	buff[1] = byte(pdu.replica)
-
-	uuid, _ := hex.DecodeString(pdu.uuid[0:32])
-	copy(buff[2:], uuid[:])
-
-	seqn := make([]byte, 8)
-	binary.BigEndian.PutUint64(seqn, uint64(pdu.seq))
-	copy(buff[18:], seqn[:])
-
-	
-	switch pdu.mtype {
-	case DAVECAST_DATA:
-		copy(buff[26:], pdu.data[:])
-
-	case DAVECAST_METADATA:
-		copy(buff[26:], pdu.metadata[:])
-
-	case DAVECAST_ANNOUNCE:
-		buff[26] = byte(pdu.atype)
-		copy(buff[27:], []byte(pdu.mountpoint))
-	
-	case DAVECAST_HEADERS:
-		copy(buff[26:], pdu.headers[:])
-	}
-
-	return buff
-}
-
-
-
-// RFC 4122
-func new_uuid() (string, error) {
-	uuid := make([]byte, 16)
-	n, err := io.ReadFull(rand.Reader, uuid)
-	if n != len(uuid) || err != nil {
-		return "", err
-	}
-	uuid[8] = uuid[8]&^0xc0 | 0x80 // variants 4.1.1
-	uuid[6] = uuid[6]&^0xf0 | 0x40 // v4 4.1.3
-	return fmt.Sprintf("%x", uuid[:]), nil
-}
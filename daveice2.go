@@ -17,76 +17,63 @@
 package main
 
 import (
-	"crypto/rand"
-	"encoding/binary"
 	"fmt"
-	"io"
 	"log"
-	"net"
 	"os"
 	"strings"
 	"time"
 
 	"adts"
 	"icecast"
+	"protocol"
+	"source"
 )
 
-const DAVECAST_DATA = 0
-const DAVECAST_METADATA = 1
-const DAVECAST_ANNOUNCE = 2
-const DAVECAST_HEADERS = 3
-
-const AAC_2C_44100_48000 = 0
-const MP3_2C_44100_128000 = 1
-const AAC_2C_44100_192000 = 2
-const AAC_2C_44100_128000 = 3
-const MP3_1C_44100_48000 = 4
-const AAC_2C_44100_24000 = 5
-
-type nanosec int64
-type davecast struct {
-	time       nanosec
-	mtype      int
-	replica    int
-	uuid       []byte
-	seq        uint64
-	data       []byte
-	mountpoint string
-	metadata   string
-	atype      int
-	headers    string
-}
-
-var relays []chan []byte
-var seq uint64 = 0
+var relays *source.Relays
 
 func main() {
-	server := os.Args[1]
-	stream := os.Args[2]
-
-	for n := 3; n < len(os.Args); n++ {
-		r := make(chan []byte, 100)
-		relays = append(relays, r)
-		if strings.Contains(os.Args[n], "@") {
-			go udp_client(strings.Replace(os.Args[n], "@", ":", 1), r)
-		} else {
-			go tcp_client(os.Args[n], r)
-		}
+	var args source.Settings
+
+	if len(os.Args) > 2 {
+		args = source.Settings{Server: os.Args[1], Stream: os.Args[2],
+			Destinations: os.Args[3:]}
 	}
 
-	dc := make(chan davecast, 10)
+	// server, stream and destinations in the file take precedence
+	s, err := source.Load(args)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if s.Server == "" || s.Stream == "" {
+		log.Fatal("server and stream must be given")
+	}
+
+	if relays, err = source.NewRelays(100); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := relays.Update(s.Destinations); err != nil {
+		log.Fatal(err)
+	}
+
+	// destinations may be changed by reloading the file (SIGHUP)
+	source.Reload(args, func(n source.Settings) {
+		s.WarnRestart(n)
+		if err := relays.Update(n.Destinations); err != nil {
+			log.Println("destinations not changed:", err)
+		}
+	})
+
+	dc := make(chan protocol.PDU, 10)
 	defer close(dc)
 
 	go relay_pdu(dc)
-	http_client(server, stream, dc)
+	http_client(s.Server, s.Stream, dc)
 }
 
-func relay_pdu(dc chan davecast) {
-	defer func() {
-		for _, r := range relays {
-			close(r)
-		}
-	}()
+func relay_pdu(dc chan protocol.PDU) {
+	defer relays.Close()
 
 	for {
 		select {
@@ -99,190 +86,85 @@ func relay_pdu(dc chan davecast) {
 				return
 			}
 
-			pdu.seq = seq
-			seq++
-
-			for n, r := range relays {
-				pdu.replica = n
-				select {
-				case r <- pdu_to_bytes(pdu):
-				default:
-				}
-			}
+			relays.Send(pdu)
 		}
 	}
 }
 
-func udp_client(addr string, messages chan []byte) {
-
-	defer func() {
-		time.Sleep(3000 * time.Millisecond)
-		go udp_client(addr, messages)
-	}()
-
-	// connect to this socket
-	if conn, err := net.Dial("udp", addr); err != nil {
-		return
-	} else {
-		defer func() {
-			//log.Printf("udp closing: %s\n", addr);
-			conn.Close()
-		}()
-
-		log.Printf("udp opened: %s\n", addr)
-
-		for {
-			buff := <-messages
-			if _, err := conn.Write(buff); err != nil {
-				log.Println("Error writing:", err.Error())
-				return
-			}
+// the stream is announced as soon as a frame header can be parsed;
+// the bitrate is then checked against the average over this many
+// frames (~2s of audio at 44.1kHz), which VBR streams need
+const PROBE_FRAMES = 100
+
+func http_client(server string, mountpoint string, dc chan protocol.PDU) {
+	var pdu protocol.PDU
+	pdu.Mountpoint = mountpoint
+	pdu.Codec = protocol.LegacyCodec(protocol.AAC_2C_44100_48000)
+	started := false
+
+	// messages are held back until the frames have been probed
+	var probe adts.Probe
+	var pending []protocol.PDU
+	probing := true
+	frames := 0
+
+	// once the codec is known frames are stamped with their position in
+	// the stream and, from that and when they were read, the time they
+	// were captured (PROTOCOL=2 only)
+	var samples uint64
+	var clock source.Clock
+
+	dispatch := func(p protocol.PDU) {
+		if p.Type == protocol.DATA {
+			p.Time = clock.Stamp(p.Time, samples, pdu.Codec)
+			p.Samples = samples
+			samples += uint64(pdu.Codec.FrameSamples())
 		}
+		dc <- p
 	}
-}
 
-func tcp_client(addr string, messages chan []byte) {
-
-	defer func() {
-		time.Sleep(3000 * time.Millisecond)
-		go tcp_client(addr, messages)
-	}()
-
-	// connect to this socket
-	if conn, err := net.Dial("tcp", addr); err != nil {
-		return
-	} else {
-		defer func() {
-			log.Printf("tcp closing: %s\n", addr)
-			conn.Close()
-		}()
-
-		log.Printf("tcp opened: %s\n", addr)
-
-		for {
-			buff := <-messages
-			out := make([]byte, len(buff)+2)
-			out[0] = byte(len(buff) >> 8)
-			out[1] = byte(len(buff) % 256)
-			copy(out[2:], buff[:])
-			if n, err := conn.Write(out); err != nil || n != len(out) {
-				log.Printf("Error writing: %s", err.Error())
-				return
-			}
+	send := func(p protocol.PDU) {
+		if probing {
+			pending = append(pending, p)
+		} else {
+			dispatch(p)
 		}
 	}
-}
-
-func pdu_to_bytes(pdu davecast) []byte {
-	size := 26
-	seqn := make([]byte, 8)
-	binary.BigEndian.PutUint64(seqn, uint64(pdu.seq))
-
-	switch pdu.mtype {
-	case DAVECAST_DATA:
-		size += len(pdu.data)
-	case DAVECAST_METADATA:
-		size += len(pdu.metadata)
-	case DAVECAST_ANNOUNCE:
-		size += (1 + len(pdu.mountpoint))
-	case DAVECAST_HEADERS:
-		size += len(pdu.headers)
-	}
-
-	buff := make([]byte, size)
-	buff[0] = byte(pdu.mtype)
-	buff[1] = byte(pdu.replica)
-	copy(buff[2:], pdu.uuid[0:16])
-	copy(buff[18:], seqn[:])
-
-	switch pdu.mtype {
-	case DAVECAST_DATA:
-		copy(buff[26:], pdu.data[:])
-
-	case DAVECAST_METADATA:
-		copy(buff[26:], pdu.metadata[:])
-
-	case DAVECAST_ANNOUNCE:
-		buff[26] = byte(pdu.atype)
-		copy(buff[27:], []byte(pdu.mountpoint))
-
-	case DAVECAST_HEADERS:
-		copy(buff[26:], pdu.headers[:])
-	}
-
-	return buff
-}
-
-// RFC 4122
-func new_uuid() []byte {
-	uuid := make([]byte, 16)
-	n, err := io.ReadFull(rand.Reader, uuid)
-	if n != len(uuid) || err != nil {
-		panic("unable to read random data")
-	}
-	uuid[8] = uuid[8]&^0xc0 | 0x80 // variants 4.1.1
-	uuid[6] = uuid[6]&^0xf0 | 0x40 // v4 4.1.3
-	return uuid[:]
-}
-
-func http_client(server string, mountpoint string, dc chan davecast) {
-	var pdu davecast
-	pdu.mountpoint = mountpoint
-	pdu.atype = AAC_2C_44100_48000
-	pdu.uuid = nil
 
 	source := fmt.Sprintf("http://%s/%s", server, mountpoint)
 	//parser := other_parser()
 	parser := adts.RAW()	
 
 	icecast.Open(source, func(buff []byte, is_meta bool, i icecast.Icecast) {
-		if pdu.uuid == nil {
-			pdu.uuid = new_uuid()
+		if !started {
+			if uuid, err := protocol.NewUUID(); err != nil {
+				panic("unable to read random data")
+			} else {
+				pdu.UUID = uuid
+			}
+			started = true
 
-			mtype := "UNK"
+			pdu.Codec.Codec = protocol.CODEC_MP3
+			pdu.Codec.Profile = protocol.PROFILE_MP3
 
 			switch i.ContentType {
 			case "audio/aac":
-				mtype = "AAC"
+				pdu.Codec.Codec = protocol.CODEC_AAC
+				pdu.Codec.Profile = protocol.PROFILE_AAC_LC
 				parser = adts.ADTS()
 
-			case "audio/aacp":
-				mtype = "AAC"
+			case "audio/aacp": // often AAC-LC - see probed_codec()
+				pdu.Codec.Codec = protocol.CODEC_AAC
+				pdu.Codec.Profile = protocol.PROFILE_AAC_LC
 				parser = adts.ADTS()
 
 			case "audio/mpeg":
-				mtype = "MP3"
 				parser = adts.MPEG()
 			}
 
-			ice_ainfo := fmt.Sprintf("%s_%dC_%d_%d000", mtype, i.Channels,
-				i.SampleRate, i.BitRate)
-
-			log.Println(ice_ainfo)
-
-			switch ice_ainfo {
-			case "AAC_2C_44100_48000":
-				pdu.atype = AAC_2C_44100_48000
-
-			case "MP3_2C_44100_128000":
-				pdu.atype = MP3_2C_44100_128000
-
-			case "AAC_2C_44100_192000":
-				pdu.atype = AAC_2C_44100_192000
-
-			case "AAC_2C_44100_128000":
-				pdu.atype = AAC_2C_44100_128000
-
-			case "MP3_1C_44100_48000":
-				pdu.atype = MP3_1C_44100_48000
-
-			case "AAC_2C_44100_24000":
-				pdu.atype = AAC_2C_44100_24000
-
-			default:
-				log.Println("OOPS", ice_ainfo)
-				pdu.atype = MP3_2C_44100_128000
-			}
+			pdu.Codec.Channels = uint8(i.Channels)
+			pdu.Codec.SampleRate = uint32(i.SampleRate)
+			pdu.Codec.Bitrate = uint32(i.BitRate) * 1000
 
 			headers := make([]string, 0)
 
@@ -294,31 +176,103 @@ func http_client(server string, mountpoint string, dc chan davecast) {
 				}
 			}
 
-			pdu.headers = strings.Join(headers, "\n")
+			pdu.Headers = strings.Join(headers, "\n")
 		}
 
 		if is_meta {
 			log.Println("META", string(buff))
-			pdu.mtype = DAVECAST_ANNOUNCE
-			dc <- pdu
+			pdu.Type = protocol.ANNOUNCE
+			send(pdu)
 
-			pdu.mtype = DAVECAST_METADATA
-			pdu.metadata = string(buff)
-			dc <- pdu
+			pdu.Type = protocol.METADATA
+			pdu.Metadata = protocol.ParseICY(buff)
+			send(pdu)
 
-			pdu.mtype = DAVECAST_HEADERS
-			dc <- pdu
+			pdu.Type = protocol.HEADERS
+			send(pdu)
 		} else {
 			parser(buff, func(b []byte) {
 				//log.Println("DATA", len(b))
-				pdu.mtype = DAVECAST_DATA
-				pdu.data = b
-				dc <- pdu
+				pdu.Type = protocol.DATA
+				pdu.Data = b
+				pdu.Time = time.Now().UnixNano()
+				send(pdu)
+
+				if probing {
+					frames++
+
+					// or give up and use the headers if none can be
+					if probe.Add(b) || frames >= PROBE_FRAMES {
+						pdu.Codec = probed_codec(pdu.Codec, probe.Info(), mountpoint)
+						probing = false
+
+						// announce straight away rather than waiting
+						// for the next metadata block
+						a := pdu
+						a.Type = protocol.ANNOUNCE
+						dc <- a
+
+						for _, p := range pending {
+							if p.Type == protocol.ANNOUNCE {
+								p.Codec = pdu.Codec
+							}
+							dispatch(p)
+						}
+						pending = nil
+					}
+				} else if n := probe.Info().Frames; n > 0 && n < PROBE_FRAMES {
+					if probe.Add(b) && n+1 == PROBE_FRAMES {
+						pdu.Codec.Bitrate = probed_bitrate(pdu.Codec, probe.Info(), mountpoint)
+					}
+				}
 			})
 		}
 	})
 }
 
+// probed_codec returns the codec derived from the frames themselves,
+// logging where this disagrees with the codec from the HTTP headers
+func probed_codec(hdr protocol.Codec, info adts.Info, mountpoint string) protocol.Codec {
+	if info.Frames == 0 {
+		log.Println("WARN", mountpoint, "no frames could be probed, using headers", hdr)
+		return hdr
+	}
+
+	c := source.Probed(info, hdr) // HE-AAC only if Ice-Audio-Info shows it
+
+	// one frame says little about the bitrate, so go with the headers
+	// until there are enough to check - see probed_bitrate()
+	c.Bitrate = hdr.Bitrate
+	if c.Bitrate == 0 {
+		c.Bitrate = uint32(info.Bitrate)
+	}
+
+	if c.Codec != hdr.Codec || c.SampleRate != hdr.SampleRate || c.Channels != hdr.Channels {
+		log.Println("WARN", mountpoint, "headers say", hdr, "but frames are", c)
+	}
+
+	log.Println(mountpoint, c, info.Frames, "frames")
+
+	if relays.Version == 1 && !c.HasLegacy() {
+		log.Println("OOPS", c, "has no v1 audio type - use PROTOCOL=2")
+	}
+
+	return c
+}
+
+// probed_bitrate returns the average bitrate of the frames probed if it
+// is more than 10% out from that announced, which later announcements
+// will then carry
+func probed_bitrate(c protocol.Codec, info adts.Info, mountpoint string) uint32 {
+	if d := info.Bitrate - int(c.Bitrate); d*10 > int(c.Bitrate) || -d*10 > int(c.Bitrate) {
+		log.Println("WARN", mountpoint, "announced", c.Kbps(), "kbps but", info.Frames, "frames average",
+			(info.Bitrate+500)/1000)
+		return uint32(info.Bitrate)
+	}
+
+	return c.Bitrate
+}
+
 func other_parser() func([]byte, func([]byte)) {
 	var frame [65536]byte
 	var last byte = 0x00
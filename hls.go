@@ -25,10 +25,13 @@ import (
 	"regexp"
 	"sort"
 	"strconv"
+	"sync"
 	"time"
 
 	"adts"
 	"icecast"
+	"protocol"
+	"source"
 )
 
 type mountpoint struct {
@@ -36,29 +39,76 @@ type mountpoint struct {
 	chunks map[int][]byte
 	bandwidth int
 	content string
+	done chan struct{} // closed if dropped from the config file
 }
 
 var mountpoints map[string]*mountpoint
+var mu sync.Mutex // for mountpoints, which may change on SIGHUP
 
 func main() {
 	mountpoints = make(map[string]*mountpoint)
-	address := os.Args[1]
-	server := os.Args[2]
 
-	for n := 3; n < len(os.Args); n++ {
-		var mp mountpoint
-		go icyclient(server, os.Args[n], &mp)
-		mountpoints[os.Args[n]] = &mp
+	var args source.Settings
+
+	if len(os.Args) > 2 {
+		args = source.Settings{Listen: os.Args[1], Server: os.Args[2], Streams: os.Args[3:]}
+	}
+
+	// address, server and streams in the file take precedence
+	s, err := source.Load(args)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	source.Reload(args, func(n source.Settings) {
+		s.WarnRestart(n)
+		update(s.Server, n.Streams)
+	})
+
+	if s.Listen == "" || s.Server == "" {
+		log.Fatal("address and server must be given")
+	}
+
+	update(s.Server, s.Streams)
+	hls_server(s.Listen)
+}
+
+// start segmenting any new streams, and stop serving and reading
+// those no longer listed
+func update(server string, streams []string) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	for name, mp := range mountpoints {
+		found := false
+		for _, s := range streams {
+			found = found || s == name
+		}
+		if !found {
+			log.Println("dropped", name)
+			close(mp.done)
+			delete(mountpoints, name)
+		}
 	}
 
-	hls_server(address)
+	for _, name := range streams {
+		if _, ok := mountpoints[name]; !ok {
+			mp := &mountpoint{done: make(chan struct{})}
+			go icyclient(server, name, mp)
+			mountpoints[name] = mp
+		}
+	}
 }
 
 func icyclient(server string, mountpoint string, mp *mountpoint) {
 	source := fmt.Sprintf("http://%s/%s", server, mountpoint)
 
 	defer func() {
-		time.Sleep(3000 * time.Millisecond)
+		select {
+		case <-mp.done:
+			return
+		case <-time.After(3000 * time.Millisecond):
+		}
 		go icyclient(server, mountpoint, mp)
 	}()
 
@@ -71,7 +121,7 @@ func icyclient(server string, mountpoint string, mp *mountpoint) {
 
 	frames := adts.NIL()
 
-	r := icecast.Open(source, func(buff []byte, meta bool, i icecast.Icecast) {
+	r := icecast.OpenUntil(source, mp.done, func(buff []byte, meta bool, i icecast.Icecast) {
 		if frames == nil {
 			switch i.ContentType {
 			case "audio/aac":
@@ -90,11 +140,8 @@ func icyclient(server string, mountpoint string, mp *mountpoint) {
 		if meta {
 			//f := adts.AdtsMetadataFrame(buff)
 			//stream <- f
-			max := 50
-			if len(buff) < max {
-				max = len(buff)
-			}
-			log.Printf("%d: %s\n", i.MetadataInterval, string(buff[0:max]))
+			m := protocol.ParseICY(buff)
+			log.Printf("%d: %s\n", i.MetadataInterval, m.StreamTitle)
 		} else {
 			frames(buff, func(b []byte) { stream <- b })
 		}
@@ -167,7 +214,11 @@ func hls_server(addr string) {
 
 		var mp *mountpoint
 
-		if m, ok := mountpoints[match[1]]; !ok {
+		mu.Lock()
+		m, ok := mountpoints[match[1]]
+		mu.Unlock()
+
+		if !ok {
 			w.WriteHeader(http.StatusNotFound)
 			return
 		} else {
@@ -43,6 +43,19 @@ func (f Frame) Private () int {
 func (f Frame) ChannelConfiguration () int {
 	return (int(f[2]&1) << 2) + (int(f[3]&192) >>6)
 }
+func (f Frame) SampleRate () int {
+	if i := f.SamplingFrequencyIndex(); i < len(adtsSampleRates) {
+		return adtsSampleRates[i]
+	}
+	return -1
+}
+func (f Frame) Channels () int {
+	if c := f.ChannelConfiguration(); c == 7 {
+		return 8
+	} else {
+		return c
+	}
+}
 func (f Frame) Originality () int {
 	return int(f[3]&32) >> 5
 }
@@ -95,6 +108,90 @@ func (f Frame) AACFrame () []byte {
 
 
 
+var adtsSampleRates = []int{96000, 88200, 64000, 48000, 44100, 32000,
+	24000, 22050, 16000, 12000, 11025, 8000, 7350}
+
+// Info describes the audio found by a Probe
+type Info struct {
+	AAC        bool // ADTS AAC, otherwise MPEG audio
+	Profile    int  // MPEG-4 audio object type (AAC) or layer (MPEG)
+	SampleRate int
+	Channels   int
+	Bitrate    int  // average over all frames, bits per second
+	Frames     int  // number of frames examined
+}
+
+// Probe derives stream parameters from the frames themselves rather
+// than trusting the HTTP headers. Frames are passed to Add as they
+// are split out by ADTS() or MPEG(); Info can be called at any time.
+type Probe struct {
+	info    Info
+	bytes   int
+	seconds float64
+}
+
+// Add examines a frame, returning false if it could not be parsed
+func (p *Probe) Add (f []byte) bool {
+	if len(f) < 7 || f[0] != 0xff {
+		return false
+	}
+
+	var samples, rate int
+
+	if f[1]&0xf6 == 0xf0 { // ADTS: 12 bit sync, layer 0
+		frame := Frame(f)
+		rate = frame.SampleRate()
+		if rate < 0 {
+			return false
+		}
+		samples = 1024 * (frame.NumberAACFrames() + 1)
+		p.info.AAC = true
+		p.info.Profile = frame.Profile() + 1
+		p.info.Channels = frame.Channels()
+
+	} else if f[1]&0xe0 == 0xe0 { // MPEG: 11 bit sync
+		version_id := int((f[1] & 0x18) >> 3)
+		layer_desc := int((f[1] & 0x6) >> 1)
+		sample_rate_frequency_index := int((f[2] & 0xc) >> 2)
+
+		if version_id == 1 || layer_desc == 0 || sample_rate_frequency_index == 3 {
+			return false // reserved values
+		}
+
+		rate = mpegSampleRate(version_id, sample_rate_frequency_index)
+
+		switch {
+		case layer_desc == 3:
+			samples = 384
+		case layer_desc == 1 && version_id != 3:
+			samples = 576
+		default:
+			samples = 1152
+		}
+
+		p.info.AAC = false
+		p.info.Profile = 4 - layer_desc
+		p.info.Channels = 2
+		if (f[3]&0xc0)>>6 == 3 {
+			p.info.Channels = 1
+		}
+	} else {
+		return false
+	}
+
+	p.info.SampleRate = rate
+	p.info.Frames++
+	p.bytes += len(f)
+	p.seconds += float64(samples) / float64(rate)
+	p.info.Bitrate = int(float64(p.bytes*8) / p.seconds)
+
+	return true
+}
+
+func (p *Probe) Info () Info {
+	return p.info
+}
+
 func ADTS () func([]byte, func([]byte)) {
 	var raw [65536]byte
 	//var frame Frame
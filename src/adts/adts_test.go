@@ -0,0 +1,97 @@
+package adts
+
+import (
+	"testing"
+)
+
+// an ADTS frame of n bytes (no CRC, one raw data block)
+func adts(profile, index, channels, n int) []byte {
+	f := make([]byte, n)
+	f[0] = 0xff
+	f[1] = 0xf1
+	f[2] = byte(profile-1)<<6 | byte(index)<<2 | byte(channels>>2)
+	f[3] = byte(channels&3)<<6 | byte(n>>11)
+	f[4] = byte(n >> 3)
+	f[5] = byte(n&7)<<5 | 0x1f
+	f[6] = 0xfc
+	return f
+}
+
+// an MPEG-1 layer III frame header, 128kbps at 44.1kHz, padded to n bytes
+func mpeg(mono bool, n int) []byte {
+	f := make([]byte, n)
+	f[0], f[1], f[2] = 0xff, 0xfb, 0x90
+	if mono {
+		f[3] = 0xc0
+	}
+	return f
+}
+
+func TestProbe(t *testing.T) {
+	for _, x := range []struct {
+		name  string
+		frame []byte
+		want  Info
+	}{
+		{"AAC-LC", adts(2, 4, 2, 372), Info{AAC: true, Profile: 2, SampleRate: 44100, Channels: 2, Bitrate: 128165}},
+		{"AAC-LC 8ch", adts(2, 3, 7, 372), Info{AAC: true, Profile: 2, SampleRate: 48000, Channels: 8, Bitrate: 139500}},
+
+		// implicitly signalled HE-AAC is indistinguishable from LC at
+		// half the sample rate - the encoders fix it up from headers
+		{"HE-AAC", adts(2, 7, 2, 186), Info{AAC: true, Profile: 2, SampleRate: 22050, Channels: 2, Bitrate: 32041}},
+
+		{"MP3", mpeg(false, 417), Info{Profile: 3, SampleRate: 44100, Channels: 2, Bitrate: 127706}},
+		{"MP3 mono", mpeg(true, 417), Info{Profile: 3, SampleRate: 44100, Channels: 1, Bitrate: 127706}},
+	} {
+		var p Probe
+
+		for n := 0; n < 2; n++ {
+			if !p.Add(x.frame) {
+				t.Fatalf("%s: not parsed", x.name)
+			}
+		}
+
+		x.want.Frames = 2
+
+		if i := p.Info(); i != x.want {
+			t.Errorf("%s: got %+v, want %+v", x.name, i, x.want)
+		}
+	}
+}
+
+func TestProbeBad(t *testing.T) {
+	bad := func(f []byte, b ...byte) []byte {
+		copy(f, b)
+		return f
+	}
+
+	for _, x := range []struct {
+		name  string
+		frame []byte
+	}{
+		{"short", adts(2, 4, 2, 372)[:6]},
+		{"no sync", bad(adts(2, 4, 2, 372), 0xfe)},
+		{"sample rate", adts(2, 13, 2, 372)},
+		{"MPEG version", bad(mpeg(false, 417), 0xff, 0xeb)},
+		{"MPEG sample rate", bad(mpeg(false, 417), 0xff, 0xfb, 0x9c)},
+	} {
+		var p Probe
+
+		if p.Add(x.frame) {
+			t.Errorf("%s: parsed", x.name)
+		}
+
+		if i := p.Info(); i != (Info{}) {
+			t.Errorf("%s: got %+v", x.name, i)
+		}
+	}
+
+	// a good frame after a bad one is counted
+	var p Probe
+	p.Add(adts(2, 13, 2, 372))
+	p.Add(adts(2, 4, 2, 372))
+
+	if i := p.Info(); i.Frames != 1 || i.SampleRate != 44100 {
+		t.Errorf("got %+v", i)
+	}
+}
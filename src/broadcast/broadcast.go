@@ -0,0 +1,198 @@
+// Package broadcast provides a ring buffer of stream data which is
+// written by one goroutine and read by any number of listeners, each
+// at its own offset, so that serving a listener costs no more than
+// copying the bytes it is sent.
+package broadcast
+
+import (
+	"errors"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	ErrLagged  = errors.New("broadcast: reader fell behind")
+	ErrTimeout = errors.New("broadcast: no data")
+)
+
+// Offsets are counted in bytes from the start of the stream, so a
+// reader's offset remains valid as the buffer wraps. Each Write is
+// taken to be a whole frame so that readers can start on a frame
+// boundary.
+type Buffer struct {
+	mu     sync.Mutex
+	data   []byte
+	head   uint64        // offset after the last byte written
+	wait   chan struct{} // closed when data is written or buffer closed
+	closed bool
+	meta   []marker // metadata changes, in order
+	frames []uint64 // offsets of the frames still held, in order
+}
+
+type marker struct {
+	off  uint64
+	data []byte
+}
+
+func New(size int) *Buffer {
+	return &Buffer{data: make([]byte, size), wait: make(chan struct{})}
+}
+
+// Write appends data, waking any readers waiting for it
+func (b *Buffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return 0, io.ErrClosedPipe
+	}
+
+	n := len(p)
+	size := uint64(len(b.data))
+
+	b.frames = append(b.frames, b.head)
+
+	for len(p) > 0 {
+		c := copy(b.data[b.head%size:], p)
+		p = p[c:]
+		b.head += uint64(c)
+	}
+
+	close(b.wait)
+	b.wait = make(chan struct{})
+
+	i := 0
+	for i < len(b.frames) && b.head-b.frames[i] > size {
+		i++
+	}
+	b.frames = b.frames[i:]
+
+	return n, nil
+}
+
+// Close ends the stream - readers get io.EOF once they have read
+// everything written
+func (b *Buffer) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.closed {
+		b.closed = true
+		close(b.wait)
+	}
+
+	return nil
+}
+
+// Head returns the offset at which the next byte will be written
+func (b *Buffer) Head() uint64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.head
+}
+
+// Burst returns the offset of the earliest frame which starts no
+// more than n bytes before the head, so that a new reader can be
+// sent a backlog of up to n bytes. The head is returned if n is less
+// than the last frame or nothing has been written.
+func (b *Buffer) Burst(n int) uint64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	i := sort.Search(len(b.frames), func(i int) bool {
+		return b.head-b.frames[i] <= uint64(n)
+	})
+
+	if i == len(b.frames) {
+		return b.head
+	}
+
+	return b.frames[i]
+}
+
+// Read copies data from offset off into p, waiting up to timeout for
+// it to be written. ErrLagged is returned if the data at off has
+// already been overwritten.
+func (b *Buffer) Read(off uint64, p []byte, timeout time.Duration) (int, error) {
+	var timer *time.Timer
+
+	for {
+		b.mu.Lock()
+
+		size := uint64(len(b.data))
+
+		if off > b.head || b.head-off > size {
+			b.mu.Unlock()
+			return 0, ErrLagged
+		}
+
+		if off < b.head {
+			n := uint64(len(p))
+			if n > b.head-off {
+				n = b.head - off
+			}
+
+			i := off % size
+			c := copy(p[:n], b.data[i:])
+			copy(p[c:n], b.data)
+
+			b.mu.Unlock()
+			return int(n), nil
+		}
+
+		if b.closed {
+			b.mu.Unlock()
+			return 0, io.EOF
+		}
+
+		wait := b.wait
+		b.mu.Unlock()
+
+		if timer == nil {
+			timer = time.NewTimer(timeout)
+			defer timer.Stop()
+		}
+
+		select {
+		case <-wait:
+		case <-timer.C:
+			return 0, ErrTimeout
+		}
+	}
+}
+
+// SetMetadata records metadata which applies from the current offset
+func (b *Buffer) SetMetadata(m []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.meta = append(b.meta, marker{off: b.head, data: m})
+
+	// forget changes superseded before the oldest data still held
+	var tail uint64
+	if b.head > uint64(len(b.data)) {
+		tail = b.head - uint64(len(b.data))
+	}
+
+	n := 0
+	for n+1 < len(b.meta) && b.meta[n+1].off <= tail {
+		n++
+	}
+	b.meta = b.meta[n:]
+}
+
+// Metadata returns the metadata which applies at offset off
+func (b *Buffer) Metadata(off uint64) []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for n := len(b.meta) - 1; n >= 0; n-- {
+		if b.meta[n].off <= off {
+			return b.meta[n].data
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,107 @@
+package broadcast
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestWrap(t *testing.T) {
+	b := New(10)
+	b.Write([]byte("abcdefgh"))
+	b.Write([]byte("ijkl")) // wraps
+
+	p := make([]byte, 10)
+
+	if _, err := b.Read(1, p, 0); err != ErrLagged {
+		t.Errorf("overwritten: got %v", err)
+	}
+
+	n, err := b.Read(2, p, 0)
+	if err != nil || string(p[:n]) != "cdefghijkl" {
+		t.Errorf("got %q, %v", p[:n], err)
+	}
+
+	n, err = b.Read(10, p[:1], 0)
+	if err != nil || string(p[:n]) != "k" {
+		t.Errorf("got %q, %v", p[:n], err)
+	}
+
+	if _, err := b.Read(13, p, 0); err != ErrLagged {
+		t.Errorf("beyond head: got %v", err)
+	}
+}
+
+func TestWait(t *testing.T) {
+	b := New(100)
+	p := make([]byte, 10)
+
+	if _, err := b.Read(0, p, time.Millisecond); err != ErrTimeout {
+		t.Errorf("empty: got %v", err)
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		b.Write([]byte("x"))
+		b.Close()
+	}()
+
+	n, err := b.Read(0, p, time.Second)
+	if err != nil || !bytes.Equal(p[:n], []byte("x")) {
+		t.Errorf("got %q, %v", p[:n], err)
+	}
+
+	if _, err := b.Read(1, p, time.Second); err != io.EOF {
+		t.Errorf("closed: got %v", err)
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	b := New(10)
+
+	if m := b.Metadata(0); m != nil {
+		t.Errorf("got %q", m)
+	}
+
+	b.SetMetadata([]byte("one"))
+	b.Write([]byte("12345"))
+	b.SetMetadata([]byte("two"))
+	b.Write([]byte("1234567890"))
+	b.SetMetadata([]byte("three"))
+
+	if m := b.Metadata(6); string(m) != "two" {
+		t.Errorf("got %q", m)
+	}
+
+	if m := b.Metadata(15); string(m) != "three" {
+		t.Errorf("got %q", m)
+	}
+
+	if len(b.meta) != 2 {
+		t.Errorf("kept %d changes", len(b.meta))
+	}
+}
+
+func TestBurst(t *testing.T) {
+	b := New(20)
+
+	if off := b.Burst(10); off != 0 {
+		t.Errorf("empty: got %d", off)
+	}
+
+	for _, f := range []string{"aaaa", "bbbbbb", "ccccc", "dddddd", "eee"} {
+		b.Write([]byte(f))
+	}
+
+	// frames start at 0, 4, 10, 15, 21 - head is 24, so 0 is gone
+	cases := []struct{ n, off int }{
+		{0, 24}, {2, 24}, {3, 21}, {8, 21}, {9, 15}, {14, 10}, {19, 10}, {20, 4}, {100, 4},
+	}
+
+	for _, c := range cases {
+		if off := b.Burst(c.n); off != uint64(c.off) {
+			t.Errorf("burst %d: got %d, want %d", c.n, off, c.off)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+// Package config reads the JSON file which configures the davecast
+// binaries (named by the CONFIG environment variable) and reads it
+// again whenever the process is sent SIGHUP. Each binary uses the
+// fields which apply to it; settings in the file take precedence over
+// arguments and environment variables.
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+type Config struct {
+	LogLevel *int `json:"log_level,omitempty"` // as DEBUG
+
+	// edges (davecast) and hls
+	Listen string `json:"listen,omitempty"` // port for listeners (address for hls)
+
+	// relays (davecast -r)
+	Sources   string   `json:"sources,omitempty"`   // port sources send to (TCP and UDP)
+	Clients   string   `json:"clients,omitempty"`   // port edges and other relays connect to
+	Multicast []string `json:"multicast,omitempty"` // groups to send everything to, as MULTICAST
+
+	// edges and relays
+	Upstreams     []string     `json:"upstreams,omitempty"` // relays (host:port), or for relays multicast groups (host@port)
+	Subscribe     []string     `json:"subscribe,omitempty"` // edges only, as SUBSCRIBE
+	Timing        Timing       `json:"timing"`
+	StreamDepth   int          `json:"stream_depth,omitempty"`   // PDUs queued for each stream and mountpoint
+	UpstreamDepth int          `json:"upstream_depth,omitempty"` // PDUs queued from each upstream relay
+	BufferSize    int          `json:"buffer_size,omitempty"`    // audio held for listeners of each mountpoint
+	Burst         *Burst       `json:"burst,omitempty"`          // as BURST
+	Metaint       *int         `json:"metaint,omitempty"`        // as METAINT
+	Splice        *bool        `json:"splice,omitempty"`         // match frames to switch in a backup, see Mountpoint
+	Mountpoints   []Mountpoint `json:"mountpoints,omitempty"`    // overrides, see Mountpoint
+
+	// sources (daveice, daveice2) and hls
+	Server       string   `json:"server,omitempty"`       // Icecast server streams are read from
+	Stream       string   `json:"stream,omitempty"`       // sources: mountpoint to publish
+	Destinations []string `json:"destinations,omitempty"` // sources: relays to send to, as arguments
+	Streams      []string `json:"streams,omitempty"`      // hls: mountpoints to segment
+}
+
+// Timing replaces the compiled in BLIP_TIME, FAIL_TIME, STALL_TIME,
+// SYNC_TIME and DEAD_TIME where set, for all mountpoints or for those
+// matching a Mountpoint
+type Timing struct {
+	Blip  Duration `json:"blip,omitempty"`  // stream considered stalled
+	Fail  Duration `json:"fail,omitempty"`  // mountpoint given up
+	Stall Duration `json:"stall,omitempty"` // stream considered stalled if a backup is ready
+	Sync  Duration `json:"sync,omitempty"`  // stalled stream resynchronised
+	Dead  Duration `json:"dead,omitempty"`  // stream expired
+}
+
+// Mountpoint overrides settings for mountpoints matching a name or
+// pattern (eg. "Heart*"). An entry naming the mountpoint exactly is
+// used, or else the first whose pattern matches.
+type Mountpoint struct {
+	Match      string   `json:"match"`
+	BufferSize int      `json:"buffer_size,omitempty"`
+	Burst      *Burst   `json:"burst,omitempty"`
+	Metaint    *int     `json:"metaint,omitempty"`          // 0 to never send metadata
+	Timeout    Duration `json:"listener_timeout,omitempty"` // drop listeners which stop reading for this long
+	Splice     *bool    `json:"splice,omitempty"`           // on failover, start the backup where its frames match those sent
+	Timing     Timing   `json:"timing"`                     // failover timing profile
+}
+
+// Duration is given as a number of seconds or a string such as "500ms"
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		t, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		*d = Duration(t)
+		return nil
+	}
+
+	var f float64
+	if err := json.Unmarshal(b, &f); err != nil {
+		return errors.New("duration must be a number of seconds or a string")
+	}
+	*d = Duration(f * float64(time.Second))
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// Burst is the backlog sent to new listeners, either in bytes or as a
+// duration of audio
+type Burst struct {
+	Bytes int
+	Time  time.Duration
+}
+
+// Set parses a number of bytes (eg. "65536") or a duration ("4s")
+func (b *Burst) Set(s string) error {
+	if n, err := strconv.Atoi(s); err == nil && n >= 0 {
+		*b = Burst{Bytes: n}
+	} else if t, err := time.ParseDuration(s); err == nil && t >= 0 {
+		*b = Burst{Time: t}
+	} else {
+		return errors.New("burst must be a number of bytes or a duration")
+	}
+	return nil
+}
+
+func (b *Burst) UnmarshalJSON(j []byte) error {
+	var s string
+	if err := json.Unmarshal(j, &s); err != nil {
+		s = string(j)
+	}
+	return b.Set(s)
+}
+
+// Size returns the burst in bytes for a stream of bitrate bits/s
+func (b Burst) Size(bitrate uint32) int {
+	if b.Time == 0 {
+		return b.Bytes
+	}
+	return int(b.Time.Seconds() * float64(bitrate) / 8)
+}
+
+// Load reads and checks the named file
+func Load(name string) (*Config, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var c Config
+	d := json.NewDecoder(f)
+	d.DisallowUnknownFields() // catch typos rather than ignore them
+
+	if err := d.Decode(&c); err != nil {
+		return nil, errors.New(name + ": " + err.Error())
+	}
+
+	return &c, nil
+}
+
+// Reload reads the named file each time the process is sent SIGHUP
+// and calls apply with it. A file which cannot be read is logged and
+// apply is not called, leaving the previous settings in effect.
+func Reload(name string, apply func(*Config)) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	go func() {
+		for range hup {
+			c, err := Load(name)
+			if err != nil {
+				log.Println("config not reloaded:", err)
+				continue
+			}
+			log.Println("config reloaded from", name)
+			apply(c)
+		}
+	}()
+}
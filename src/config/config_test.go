@@ -0,0 +1,93 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "davecast.json")
+
+	os.WriteFile(file, []byte(`{
+		"log_level": 3,
+		"listen": "8000",
+		"upstreams": ["127.0.0.1:8001", "127.0.0.1:8002"],
+		"timing": {"blip": 4, "fail": "8s", "dead": "1m"},
+		"burst": "4s",
+		"splice": true,
+		"mountpoints": [
+			{"match": "Heart*", "buffer_size": 524288, "burst": 131072, "metaint": 0, "listener_timeout": "500ms",
+			 "timing": {"blip": 3, "fail": 5, "stall": "500ms"}}
+		]
+	}`), 0644)
+
+	c, err := Load(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.LogLevel == nil || *c.LogLevel != 3 || c.Listen != "8000" || len(c.Upstreams) != 2 {
+		t.Errorf("got %+v", c)
+	}
+
+	if c.Timing != (Timing{Blip: Duration(4 * time.Second), Fail: Duration(8 * time.Second),
+		Dead: Duration(time.Minute)}) {
+		t.Errorf("timing: got %+v", c.Timing)
+	}
+
+	if c.Burst == nil || *c.Burst != (Burst{Time: 4 * time.Second}) || c.Metaint != nil ||
+		c.Splice == nil || !*c.Splice {
+		t.Errorf("burst: got %+v", c.Burst)
+	}
+
+	if len(c.Mountpoints) != 1 {
+		t.Fatalf("mountpoints: got %+v", c.Mountpoints)
+	}
+
+	m := c.Mountpoints[0]
+	if m.Match != "Heart*" || m.BufferSize != 524288 || *m.Burst != (Burst{Bytes: 131072}) ||
+		m.Metaint == nil || *m.Metaint != 0 || m.Timeout != Duration(500*time.Millisecond) {
+		t.Errorf("override: got %+v", m)
+	}
+
+	if m.Timing != (Timing{Blip: Duration(3 * time.Second), Fail: Duration(5 * time.Second),
+		Stall: Duration(500 * time.Millisecond)}) {
+		t.Errorf("override timing: got %+v", m.Timing)
+	}
+
+	// a misspelt setting is an error rather than silently ignored
+	os.WriteFile(file, []byte(`{"upstream": ["127.0.0.1:8001"]}`), 0644)
+
+	if _, err := Load(file); err == nil {
+		t.Error("unknown field accepted")
+	}
+
+	os.WriteFile(file, []byte(`{"timing": {"blip": "6 seconds"}}`), 0644)
+
+	if _, err := Load(file); err == nil {
+		t.Error("bad duration accepted")
+	}
+}
+
+func TestBurst(t *testing.T) {
+	var b Burst
+
+	for _, s := range []string{"-1", "4 s", "", "x"} {
+		if b.Set(s) == nil {
+			t.Errorf("%q accepted", s)
+		}
+	}
+
+	b.Set("65536")
+	if b.Size(128000) != 65536 {
+		t.Errorf("bytes: got %d", b.Size(128000))
+	}
+
+	b.Set("2s")
+	if b.Size(128000) != 32000 {
+		t.Errorf("time: got %d", b.Size(128000))
+	}
+}
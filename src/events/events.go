@@ -0,0 +1,86 @@
+// Package events writes stream lifecycle events (streams starting
+// and stopping, failovers, resyncs, clients killed) as JSON lines so
+// that incidents can be reconstructed afterwards.
+package events
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// event types
+const (
+	MOUNTPOINT_UP   = "mountpoint-up"
+	MOUNTPOINT_DOWN = "mountpoint-down"
+	STREAM_UP       = "stream-up"
+	STREAM_DOWN     = "stream-down"
+	STREAM_DETACHED = "stream-detached" // from its mountpoint, until it is next announced
+	FAILOVER        = "failover"
+	RESYNC          = "resync"
+	CLIENT_KILL     = "client-kill"
+)
+
+// An Event is one line of the log. Only the fields which apply to
+// the type are given.
+type Event struct {
+	Time       time.Time `json:"time"`
+	Event      string    `json:"event"`
+	Mountpoint string    `json:"mountpoint,omitempty"`
+	UUID       string    `json:"uuid,omitempty"`
+	Replica    *int      `json:"replica,omitempty"`
+	From       string    `json:"from,omitempty"` // FAILOVER: uuid of the stream which stalled
+	Client     string    `json:"client,omitempty"`
+	Reason     string    `json:"reason,omitempty"`
+	Gap        uint64    `json:"gap,omitempty"`           // RESYNC: sequence numbers skipped
+	Offset     int       `json:"replay_offset,omitempty"` // FAILOVER: PDUs of the backup skipped
+	Replayed   int       `json:"replayed,omitempty"`      // FAILOVER: PDUs of the backup replayed
+	Splice     string    `json:"splice,omitempty"`        // FAILOVER: how the backup was matched, if not by arrival time
+}
+
+// A Log writes events to a file. A nil Log discards them.
+type Log struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// Open appends to the named file, or writes to stdout if name is "-"
+func Open(name string) (*Log, error) {
+	var w io.Writer = os.Stdout
+
+	if name != "-" {
+		f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, err
+		}
+		w = f
+	}
+
+	return New(w), nil
+}
+
+func New(w io.Writer) *Log {
+	return &Log{enc: json.NewEncoder(w)}
+}
+
+// Log writes an event, timestamped now if Time is not set
+func (l *Log) Log(e Event) {
+	if l == nil {
+		return
+	}
+
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.enc.Encode(e)
+}
+
+// Replica returns a pointer to a replica number, for Event
+func Replica(r int) *int {
+	return &r
+}
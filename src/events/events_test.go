@@ -0,0 +1,41 @@
+package events
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestLog(t *testing.T) {
+	var nothing *Log
+	nothing.Log(Event{Event: FAILOVER}) // discarded
+
+	var b bytes.Buffer
+	l := New(&b)
+
+	l.Log(Event{Event: STREAM_UP, Mountpoint: "Capital", UUID: "u", Replica: Replica(0)})
+	l.Log(Event{Event: RESYNC, Time: time.Unix(0, 0).UTC(), Gap: 12})
+
+	lines := bytes.Split(bytes.TrimSpace(b.Bytes()), []byte("\n"))
+	if len(lines) != 2 {
+		t.Fatalf("got %q", b.String())
+	}
+
+	var e map[string]interface{}
+
+	if err := json.Unmarshal(lines[0], &e); err != nil {
+		t.Fatal(err)
+	}
+	if e["event"] != STREAM_UP || e["replica"] != 0.0 || e["time"] == nil || e["gap"] != nil {
+		t.Errorf("stream-up: got %v", e)
+	}
+
+	e = nil
+	if err := json.Unmarshal(lines[1], &e); err != nil {
+		t.Fatal(err)
+	}
+	if e["gap"] != 12.0 || e["replica"] != nil || e["time"] != "1970-01-01T00:00:00Z" {
+		t.Errorf("resync: got %v", e)
+	}
+}
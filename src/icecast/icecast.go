@@ -1,6 +1,7 @@
 package icecast
 
 import (
+	"context"
 	"io"
 	"net/http"
 	"log"
@@ -38,6 +39,12 @@ func (i Icecast) Endpoint() string {
 }
 
 func Open(endpoint string, callback func([]byte, bool, Icecast)) (int) {
+	return OpenUntil(endpoint, nil, callback)
+}
+
+// OpenUntil is Open, but gives up on the stream once done is closed -
+// a live stream would otherwise be read forever
+func OpenUntil(endpoint string, done <-chan struct{}, callback func([]byte, bool, Icecast)) (int) {
 	var i Icecast
 	i.endpoint = endpoint
 	i.callback = callback
@@ -46,18 +53,32 @@ func Open(endpoint string, callback func([]byte, bool, Icecast)) (int) {
 		//CheckRedirect: redirectPolicyFunc,
 	}
 	
-	req, err := http.NewRequest("GET", endpoint, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if done != nil {
+		go func() {
+			select {
+			case <-done:
+				cancel() // closes the body, ending the read below
+			case <-ctx.Done():
+			}
+		}()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", endpoint, nil)
 	req.Header.Add("Icy-MetaData", "1")
 	resp, err := client.Do(req)
 
-	if resp.StatusCode != 200 {
-		return resp.StatusCode
-	}
-
 	if err != nil {
 		log.Println(endpoint, "doh", err)
 		return -1
 	}
+
+	if resp.StatusCode != 200 {
+		resp.Body.Close()
+		return resp.StatusCode
+	}
 	
 	defer resp.Body.Close()
 
@@ -0,0 +1,202 @@
+// Package mcast opens UDP sockets for sending to multicast groups
+// with control over the TTL, outgoing interface and loopback, and
+// for receiving from them on a given interface.
+package mcast
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// HostPort converts the "host@port" form used for UDP destinations
+// to "host:port", bracketing IPv6 addresses - "ff15::1@9000" and
+// "[ff15::1]@9000" both give "[ff15::1]:9000"
+func HostPort(addr string) string {
+	n := strings.LastIndex(addr, "@")
+	if n < 0 {
+		return addr
+	}
+	host := strings.TrimSuffix(strings.TrimPrefix(addr[:n], "["), "]")
+	return net.JoinHostPort(host, addr[n+1:])
+}
+
+type Options struct {
+	TTL       int    // hops, 1 stays on the local network
+	Interface string // name or address of the interface to send from
+	Loop      bool   // deliver to listeners on the sending host too
+}
+
+// the socket API's defaults; the interface is chosen by routing
+var Defaults = Options{TTL: 1, Loop: true}
+
+// Set parses a destination option: "ttl=N", "if=eth0|address" or
+// "loop=0|1"
+func (o *Options) Set(key, value string) error {
+	switch key {
+	case "ttl":
+		t, err := strconv.Atoi(value)
+		if err != nil || t < 0 || t > 255 {
+			return errors.New("mcast: ttl must be 0 to 255")
+		}
+		o.TTL = t
+
+	case "if":
+		if value == "" {
+			return errors.New("mcast: if requires an interface")
+		}
+		o.Interface = value
+
+	case "loop":
+		l, err := strconv.ParseBool(value)
+		if err != nil {
+			return errors.New("mcast: loop must be 0 or 1")
+		}
+		o.Loop = l
+
+	default:
+		return errors.New("mcast: unknown option " + key)
+	}
+
+	return nil
+}
+
+// Dial connects a UDP socket to addr ("host:port"). The options are
+// applied before connecting if the host is a multicast group and are
+// ignored otherwise.
+func Dial(addr string, o Options) (*net.UDPConn, error) {
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	var d net.Dialer
+
+	if raddr.IP.IsMulticast() {
+		d.Control = func(network, address string, c syscall.RawConn) error {
+			var serr error
+			err := c.Control(func(fd uintptr) {
+				serr = o.apply(int(fd), raddr.IP.To4() != nil)
+			})
+			if err != nil {
+				return err
+			}
+			return serr
+		}
+	}
+
+	conn, err := d.Dial("udp", raddr.String())
+	if err != nil {
+		return nil, err
+	}
+
+	return conn.(*net.UDPConn), nil
+}
+
+// Listen joins the multicast group addr ("host:port") on the
+// interface given in the options, or one chosen by the system
+func Listen(addr string, o Options) (*net.UDPConn, error) {
+	gaddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	var ifi *net.Interface
+
+	if o.Interface != "" {
+		if ifi, _, err = find(o.Interface, gaddr.IP.To4() != nil); err != nil {
+			return nil, err
+		}
+	}
+
+	return net.ListenMulticastUDP("udp", ifi, gaddr)
+}
+
+func (o Options) apply(fd int, v4 bool) error {
+	loop := 0
+	if o.Loop {
+		loop = 1
+	}
+
+	if !v4 {
+		if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_MULTICAST_HOPS, o.TTL); err != nil {
+			return err
+		}
+		if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_MULTICAST_LOOP, loop); err != nil {
+			return err
+		}
+		if o.Interface == "" {
+			return nil
+		}
+		ifi, _, err := find(o.Interface, false)
+		if err != nil {
+			return err
+		}
+		return syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_MULTICAST_IF, ifi.Index)
+	}
+
+	if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_MULTICAST_TTL, o.TTL); err != nil {
+		return err
+	}
+	if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_MULTICAST_LOOP, loop); err != nil {
+		return err
+	}
+	if o.Interface == "" {
+		return nil
+	}
+	_, ip, err := find(o.Interface, true)
+	if err != nil {
+		return err
+	}
+	var a [4]byte
+	copy(a[:], ip.To4())
+	return syscall.SetsockoptInet4Addr(fd, syscall.IPPROTO_IP, syscall.IP_MULTICAST_IF, a)
+}
+
+// find an interface by name or by one of its addresses, returning
+// its first address of the family wanted
+func find(name string, v4 bool) (*net.Interface, net.IP, error) {
+	ifs, err := net.Interfaces()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	want := net.ParseIP(name)
+
+	for _, ifi := range ifs {
+		addrs, err := ifi.Addrs()
+		if err != nil {
+			continue
+		}
+
+		var first net.IP
+		match := ifi.Name == name
+
+		for _, a := range addrs {
+			ipn, ok := a.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			if want != nil && ipn.IP.Equal(want) {
+				match = true
+			}
+			if first == nil && (ipn.IP.To4() != nil) == v4 {
+				first = ipn.IP
+			}
+		}
+
+		if match {
+			if want != nil && (want.To4() != nil) == v4 {
+				first = want
+			}
+			if first == nil && v4 {
+				return nil, nil, errors.New("mcast: no IPv4 address on " + ifi.Name)
+			}
+			return &ifi, first, nil
+		}
+	}
+
+	return nil, nil, errors.New("mcast: no such interface " + name)
+}
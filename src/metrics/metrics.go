@@ -0,0 +1,188 @@
+// Package metrics keeps counters and gauges and writes them in the
+// Prometheus text exposition format, for scraping from /metrics.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// A Registry holds metric families, written in the order registered
+type Registry struct {
+	mu       sync.Mutex
+	families []*family
+	funcs    []func(io.Writer)
+}
+
+type family struct {
+	mu     sync.Mutex
+	name   string
+	help   string
+	kind   string // "counter" or "gauge"
+	labels []string
+	values map[string]*Value // by rendered label set
+}
+
+// A Value is a single time series - a counter or gauge with one set
+// of label values. It is safe for concurrent use.
+type Value struct {
+	labels string
+	v      int64
+}
+
+// Counter is a family of counters distinguished by label values
+type Counter struct{ f *family }
+
+// Gauge is a family of gauges distinguished by label values
+type Gauge struct{ f *family }
+
+// Default is the registry served by Handler
+var Default = New()
+
+func New() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) add(name, help, kind string, labels []string) *family {
+	f := &family{name: name, help: help, kind: kind, labels: labels,
+		values: make(map[string]*Value)}
+
+	r.mu.Lock()
+	r.families = append(r.families, f)
+	r.mu.Unlock()
+
+	return f
+}
+
+// NewCounter registers a counter family with the given label names
+func (r *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	return &Counter{r.add(name, help, "counter", labels)}
+}
+
+// NewGauge registers a gauge family with the given label names
+func (r *Registry) NewGauge(name, help string, labels ...string) *Gauge {
+	return &Gauge{r.add(name, help, "gauge", labels)}
+}
+
+// GaugeFunc registers a gauge family whose values are read from f at
+// each scrape - f calls set once for each time series
+func (r *Registry) GaugeFunc(name, help string, labels []string, f func(set func(v int64, values ...string))) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.funcs = append(r.funcs, func(w io.Writer) {
+		var lines []string
+		f(func(v int64, values ...string) {
+			lines = append(lines, fmt.Sprintf("%s%s %d\n", name, render(labels, values), v))
+		})
+		sort.Strings(lines)
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+		io.WriteString(w, strings.Join(lines, ""))
+	})
+}
+
+// {a="x",b="y"} - values are escaped as the format requires
+func render(labels, values []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+
+	esc := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	pairs := make([]string, len(labels))
+
+	for i, l := range labels {
+		var v string
+		if i < len(values) {
+			v = values[i]
+		}
+		pairs[i] = l + `="` + esc.Replace(v) + `"`
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func (f *family) with(values []string) *Value {
+	l := render(f.labels, values)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	v, ok := f.values[l]
+	if !ok {
+		v = &Value{labels: l}
+		f.values[l] = v
+	}
+
+	return v
+}
+
+// With returns the counter for a set of label values, which may be
+// kept to avoid looking it up again
+func (c *Counter) With(values ...string) *Value { return c.f.with(values) }
+
+// Add increases the counter for a set of label values by n
+func (c *Counter) Add(n int64, values ...string) { c.f.with(values).Add(n) }
+
+// Inc increases the counter for a set of label values by one
+func (c *Counter) Inc(values ...string) { c.f.with(values).Add(1) }
+
+// With returns the gauge for a set of label values
+func (g *Gauge) With(values ...string) *Value { return g.f.with(values) }
+
+// Set sets the gauge for a set of label values
+func (g *Gauge) Set(n int64, values ...string) { g.f.with(values).Set(n) }
+
+// Reset drops every time series, eg. before setting the current set
+func (g *Gauge) Reset() {
+	g.f.mu.Lock()
+	g.f.values = make(map[string]*Value)
+	g.f.mu.Unlock()
+}
+
+func (v *Value) Add(n int64) { atomic.AddInt64(&v.v, n) }
+func (v *Value) Set(n int64) { atomic.StoreInt64(&v.v, n) }
+func (v *Value) Get() int64  { return atomic.LoadInt64(&v.v) }
+
+func (f *family) write(w io.Writer) {
+	f.mu.Lock()
+	values := make([]*Value, 0, len(f.values))
+	for _, v := range f.values {
+		values = append(values, v)
+	}
+	f.mu.Unlock()
+
+	sort.Slice(values, func(i, j int) bool { return values[i].labels < values[j].labels })
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.kind)
+
+	for _, v := range values {
+		fmt.Fprintf(w, "%s%s %d\n", f.name, v.labels, v.Get())
+	}
+}
+
+// Write writes every metric in the text exposition format
+func (r *Registry) Write(w io.Writer) {
+	r.mu.Lock()
+	families := append([]*family{}, r.families...)
+	funcs := append([]func(io.Writer){}, r.funcs...)
+	r.mu.Unlock()
+
+	for _, f := range families {
+		f.write(w)
+	}
+
+	for _, f := range funcs {
+		f(w)
+	}
+}
+
+// Handler serves the Default registry
+func Handler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	Default.Write(w)
+}
@@ -0,0 +1,51 @@
+package metrics
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestWrite(t *testing.T) {
+	r := New()
+
+	c := r.NewCounter("test_pdus_total", "PDUs seen", "path", "why")
+	g := r.NewGauge("test_clients", "Clients connected")
+	q := r.NewGauge("test_queue", "Queue depth", "client")
+
+	c.Inc("tcp:b", `say "hi"`)
+	c.Add(3, "tcp:a", "x\\y")
+	v := c.With("tcp:a", "x\\y")
+	v.Add(1)
+	g.Set(2)
+	q.Set(5, "old")
+	q.Reset()
+	q.Set(7, "new")
+
+	r.GaugeFunc("test_listeners", "Listeners", []string{"mountpoint"}, func(set func(int64, ...string)) {
+		set(4, "Heart")
+		set(1, "Capital")
+	})
+
+	want := `# HELP test_pdus_total PDUs seen
+# TYPE test_pdus_total counter
+test_pdus_total{path="tcp:a",why="x\\y"} 4
+test_pdus_total{path="tcp:b",why="say \"hi\""} 1
+# HELP test_clients Clients connected
+# TYPE test_clients gauge
+test_clients 2
+# HELP test_queue Queue depth
+# TYPE test_queue gauge
+test_queue{client="new"} 7
+# HELP test_listeners Listeners
+# TYPE test_listeners gauge
+test_listeners{mountpoint="Capital"} 1
+test_listeners{mountpoint="Heart"} 4
+`
+
+	var b bytes.Buffer
+	r.Write(&b)
+
+	if b.String() != want {
+		t.Errorf("got:\n%s\nwant:\n%s", b.String(), want)
+	}
+}
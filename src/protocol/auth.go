@@ -0,0 +1,232 @@
+package protocol
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"os"
+	"strings"
+	"time"
+)
+
+// v2 header flag - message ends with a key id and HMAC trailer
+const FLAG_AUTH = 0x01
+
+// HMAC-SHA256 truncated to 128 bits
+const MAC_LENGTH = 16
+
+var (
+	ErrNoAuth   = errors.New("protocol: message not authenticated")
+	ErrKey      = errors.New("protocol: unknown key")
+	ErrAuth     = errors.New("protocol: authentication failed")
+	ErrMount    = errors.New("protocol: mountpoint not permitted for key")
+	ErrOwner    = errors.New("protocol: stream announced by another key")
+	ErrAnnounce = errors.New("protocol: stream not announced")
+)
+
+// A Key is a secret shared between an encoder and the relays and
+// edges, optionally restricted to a set of mountpoint patterns
+type Key struct {
+	ID          string
+	Secret      []byte
+	Mountpoints []string // path.Match patterns, any if empty
+}
+
+// Keyring maps key ids to keys
+type Keyring map[string]*Key
+
+// LoadKeys reads a key file with one key per line:
+//
+//	id secret [mountpoint ...]
+//
+// Blank lines and lines starting with "#" are ignored.
+func LoadKeys(file string) (Keyring, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	keys := make(Keyring)
+	s := bufio.NewScanner(f)
+
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		if len(fields) < 2 || len(fields[0]) > 255 {
+			return nil, errors.New("protocol: bad key line: " + fields[0])
+		}
+
+		keys[fields[0]] = &Key{ID: fields[0], Secret: []byte(fields[1]),
+			Mountpoints: fields[2:]}
+	}
+
+	return keys, s.Err()
+}
+
+// Permits reports whether the key may announce a mountpoint
+func (k *Key) Permits(mountpoint string) bool {
+	return len(k.Mountpoints) == 0 || Match(k.Mountpoints, mountpoint)
+}
+
+// the hop count is changed by relays and so is taken as zero
+func (k *Key) mac(msg []byte) []byte {
+	m := hmac.New(sha256.New, k.Secret)
+
+	m.Write(msg[:HOPS])
+	m.Write([]byte{0})
+	m.Write(msg[HOPS+1:])
+
+	return m.Sum(nil)[:MAC_LENGTH]
+}
+
+// Sign sets the FLAG_AUTH flag on a marshalled version 2 message and
+// appends the trailer: key id, key id length (1 byte) and HMAC over
+// everything preceding it
+func (k *Key) Sign(msg []byte) ([]byte, error) {
+	if len(msg) < V2_HEADER || msg[0] != MAGIC|2 {
+		return nil, ErrVersion
+	}
+
+	if len(msg)+len(k.ID)+1+MAC_LENGTH > MAX_FRAME {
+		return nil, ErrTooLong
+	}
+
+	b := make([]byte, len(msg), len(msg)+len(k.ID)+1+MAC_LENGTH)
+	copy(b, msg)
+	b[2] |= FLAG_AUTH
+	b = append(b, k.ID...)
+	b = append(b, byte(len(k.ID)))
+
+	return append(b, k.mac(b)...), nil
+}
+
+// trailer returns the key id and the length of the trailer of a
+// message with FLAG_AUTH set
+func trailer(msg []byte, h int) (string, int, error) {
+	n := len(msg) - MAC_LENGTH - 1
+
+	if n < h {
+		return "", 0, ErrShort
+	}
+
+	l := int(msg[n])
+
+	if n-l < h {
+		return "", 0, ErrShort
+	}
+
+	return string(msg[n-l : n]), l + 1 + MAC_LENGTH, nil
+}
+
+// Verify checks the HMAC trailer of a message against the keyring,
+// returning the key which signed it. Messages which are not signed
+// (including all version 1 messages) return ErrNoAuth.
+func (keys Keyring) Verify(msg []byte) (*Key, error) {
+	if len(msg) < V2_HEADER || msg[0]&0xf0 != MAGIC || msg[2]&FLAG_AUTH == 0 {
+		return nil, ErrNoAuth
+	}
+
+	id, _, err := trailer(msg, int(msg[1]))
+	if err != nil {
+		return nil, err
+	}
+
+	key, ok := keys[id]
+	if !ok {
+		return nil, ErrKey
+	}
+
+	n := len(msg) - MAC_LENGTH
+
+	if !hmac.Equal(key.mac(msg[:n]), msg[n:]) {
+		return nil, ErrAuth
+	}
+
+	return key, nil
+}
+
+// Authorize verifies a message and decodes it, also checking that the
+// key permits the mountpoint named in ANNOUNCE messages
+func (keys Keyring) Authorize(msg []byte) (*PDU, *Key, error) {
+	key, err := keys.Verify(msg)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	p, err := Unmarshal(msg)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if p.Type == ANNOUNCE && !key.Permits(p.Mountpoint) {
+		return nil, nil, ErrMount
+	}
+
+	return p, key, nil
+}
+
+// Owners binds each stream to the key which first announced it, so
+// that the holder of one key (which may be permitted any mountpoint)
+// cannot sign messages into another encoder's stream. Not safe for
+// concurrent use.
+type Owners struct {
+	Keys    Keyring
+	streams map[UUID]*owner
+}
+
+type owner struct {
+	key  string
+	seen time.Time // last announced
+}
+
+func NewOwners(keys Keyring) *Owners {
+	return &Owners{Keys: keys, streams: make(map[UUID]*owner)}
+}
+
+// Authorize is Keyring.Authorize, but also binds the stream of an
+// ANNOUNCE message to its key, and drops any message for a stream
+// which is bound to another key or has not yet been announced
+func (o *Owners) Authorize(msg []byte) (*PDU, *Key, error) {
+	p, key, err := o.Keys.Authorize(msg)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch p.Type {
+	case SUBSCRIBE, NAK: // not part of a stream
+		return p, key, nil
+	}
+
+	s, ok := o.streams[p.UUID]
+
+	switch {
+	case ok && s.key != key.ID:
+		return nil, nil, ErrOwner
+	case p.Type == ANNOUNCE && !ok:
+		s = &owner{key: key.ID}
+		o.streams[p.UUID] = s
+	case !ok:
+		return nil, nil, ErrAnnounce
+	}
+
+	if p.Type == ANNOUNCE {
+		s.seen = time.Now()
+	}
+
+	return p, key, nil
+}
+
+// Expire unbinds streams which have not been announced since t
+func (o *Owners) Expire(t time.Time) {
+	for u, s := range o.streams {
+		if s.seen.Before(t) {
+			delete(o.streams, u)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// A PARITY message covers a group of messages from a stream (DATA,
+// METADATA, ANNOUNCE and HEADERS alike, as an edge must have them all
+// to pass the stream on in sequence), allowing a receiver which has all but one of them to rebuild the
+// missing one. The body lists the sequence numbers of the group (as
+// distances back from the message's own sequence number, that of
+// the last message in the group) followed by the XOR of the message
+// types (8 bit), the XOR of the body lengths (16 bit) and the XOR of
+// the bodies, each padded with zeros to the length of the longest.
+
+// largest span of sequence numbers a PARITY message may cover
+const MAX_GROUP = 255
+
+var ErrFEC = errors.New("protocol: bad parity group")
+
+// FEC builds PARITY messages for groups of N consecutive messages
+// from one stream
+type FEC struct {
+	N     int
+	group []uint64
+	xor   []byte
+}
+
+func NewFEC(n int) *FEC {
+	return &FEC{N: n}
+}
+
+// Add includes a message in the current group, returning the PARITY
+// message for the group once it has N members. SUBSCRIBE, NAK and
+// PARITY messages are not part of the stream and are ignored.
+func (f *FEC) Add(p *PDU) *PDU {
+	switch p.Type {
+	case SUBSCRIBE, NAK, PARITY:
+		return nil
+	}
+
+	body, err := p.Body()
+	if err != nil {
+		return nil
+	}
+
+	if l := len(f.group); l > 0 && (p.Seq <= f.group[l-1] || p.Seq-f.group[0] > MAX_GROUP) {
+		f.reset() // sequence restarted
+	}
+
+	f.group = append(f.group, p.Seq)
+	f.xor = xor(f.xor, symbol(p.Type, body))
+
+	if len(f.group) < f.N {
+		return nil
+	}
+
+	parity := &PDU{Version: 2, Type: PARITY, Replica: p.Replica, UUID: p.UUID,
+		Seq: p.Seq, Group: f.group, Data: f.xor}
+
+	f.reset()
+
+	return parity
+}
+
+func (f *FEC) reset() {
+	f.group = nil
+	f.xor = nil
+}
+
+// type, length and body of a message, as covered by parity
+func symbol(t uint8, body []byte) []byte {
+	s := make([]byte, 3+len(body))
+	s[0] = t
+	binary.BigEndian.PutUint16(s[1:3], uint16(len(body)))
+	copy(s[3:], body)
+	return s
+}
+
+func xor(a, b []byte) []byte {
+	if len(a) < len(b) {
+		a = append(a, make([]byte, len(b)-len(a))...)
+	}
+
+	for n, c := range b {
+		a[n] ^= c
+	}
+
+	return a
+}
+
+// Recover rebuilds the one message of a parity group which is
+// missing, given all of the others
+func Recover(parity *PDU, others []*PDU) (*PDU, error) {
+	if parity.Type != PARITY || len(parity.Data) < 3 || len(others) != len(parity.Group)-1 {
+		return nil, ErrFEC
+	}
+
+	s := append([]byte{}, parity.Data...)
+	have := make(map[uint64]bool)
+
+	for _, o := range others {
+		body, err := o.Body()
+		if err != nil {
+			return nil, err
+		}
+
+		if 3+len(body) > len(s) {
+			return nil, ErrFEC
+		}
+
+		s = xor(s, symbol(o.Type, body))
+		have[o.Seq] = true
+	}
+
+	p := &PDU{Version: parity.Version, Replica: parity.Replica, UUID: parity.UUID}
+	missing := 0
+
+	for _, g := range parity.Group {
+		if !have[g] {
+			p.Seq = g
+			missing++
+		}
+	}
+
+	if missing != 1 {
+		return nil, ErrFEC
+	}
+
+	p.Type = s[0]
+	l := int(binary.BigEndian.Uint16(s[1:3]))
+
+	if 3+l > len(s) {
+		return nil, ErrFEC
+	}
+
+	if err := p.decode(s[3 : 3+l]); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
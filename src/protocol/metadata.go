@@ -0,0 +1,233 @@
+package protocol
+
+import (
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// longest ICY metadata block - the length byte counts 16 byte units
+const MAX_ICY = 255 * 16
+
+// Metadata describes what is playing on a stream. Version 1 METADATA
+// messages carry it as an ICY string; version 2 messages carry each
+// field as a "key\rvalue" pair, deliminated with "\n".
+type Metadata struct {
+	StreamTitle string            `json:"StreamTitle,omitempty"`
+	StreamUrl   string            `json:"StreamUrl,omitempty"`
+	Artist      string            `json:"artist,omitempty"`
+	Title       string            `json:"title,omitempty"`
+	Extra       map[string]string `json:"extra,omitempty"` // any other keys, eg. from ICY blocks
+}
+
+// keys used for the named fields in version 2 messages
+const (
+	META_STREAMTITLE = "StreamTitle"
+	META_STREAMURL   = "StreamUrl"
+	META_ARTIST      = "artist"
+	META_TITLE       = "title"
+)
+
+// IsZero reports whether no fields are set
+func (m *Metadata) IsZero() bool {
+	return m.StreamTitle == "" && m.StreamUrl == "" && m.Artist == "" &&
+		m.Title == "" && len(m.Extra) == 0
+}
+
+// Set sets a field by name, keeping unknown keys in Extra
+func (m *Metadata) Set(key, value string) {
+	switch key {
+	case META_STREAMTITLE:
+		m.StreamTitle = value
+	case META_STREAMURL:
+		m.StreamUrl = value
+	case META_ARTIST:
+		m.Artist = value
+	case META_TITLE:
+		m.Title = value
+	default:
+		if m.Extra == nil {
+			m.Extra = make(map[string]string)
+		}
+		m.Extra[key] = value
+	}
+}
+
+// the named fields first, then any others in order of key
+func (m *Metadata) fields() [][2]string {
+	var f [][2]string
+
+	for _, kv := range [][2]string{
+		{META_STREAMTITLE, m.StreamTitle},
+		{META_STREAMURL, m.StreamUrl},
+		{META_ARTIST, m.Artist},
+		{META_TITLE, m.Title},
+	} {
+		if kv[1] != "" {
+			f = append(f, kv)
+		}
+	}
+
+	keys := make([]string, 0, len(m.Extra))
+	for k := range m.Extra {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		f = append(f, [2]string{k, m.Extra[k]})
+	}
+
+	return f
+}
+
+// ParseICY decodes an ICY metadata block (without its length byte),
+// eg. "StreamTitle='Artist - Song';StreamUrl='http://x/';" then NUL
+// padding. Artist and Title are taken from a StreamTitle of the form
+// "Artist - Title". Values may contain quotes - each runs up to the
+// next "';".
+func ParseICY(b []byte) Metadata {
+	var m Metadata
+
+	s := strings.TrimRight(string(b), "\x00")
+
+	for s != "" {
+		eq := strings.Index(s, "='")
+		if eq < 0 {
+			break
+		}
+
+		key := strings.TrimSpace(strings.TrimLeft(s[:eq], ";"))
+		s = s[eq+2:]
+
+		var value string
+
+		if end := strings.Index(s, "';"); end < 0 {
+			value, s = strings.TrimSuffix(s, "'"), ""
+		} else {
+			value, s = s[:end], s[end+2:]
+		}
+
+		if key != "" && value != "" {
+			m.Set(key, value)
+		}
+	}
+
+	if m.Artist == "" && m.Title == "" {
+		if a, t, ok := strings.Cut(m.StreamTitle, " - "); ok {
+			m.Artist, m.Title = a, t
+		}
+	}
+
+	return m
+}
+
+// ICY renders the metadata as an unpadded ICY string. StreamTitle is
+// made from Artist and Title if not set and is always present, so
+// that players clear any previous title. Values are cleaned of NULs
+// and of "';", which would end them early.
+func (m *Metadata) ICY() []byte {
+	title := m.StreamTitle
+
+	if title == "" && (m.Artist != "" || m.Title != "") {
+		title = m.Artist
+		if m.Artist != "" && m.Title != "" {
+			title += " - "
+		}
+		title += m.Title
+	}
+
+	var b strings.Builder
+
+	clean := strings.NewReplacer("\x00", "", "';", "' ;")
+	title = clean.Replace(title)
+
+	icy := func(k, v string) {
+		b.WriteString(k + "='" + clean.Replace(v) + "';")
+	}
+
+	icy(META_STREAMTITLE, title)
+
+	if m.StreamUrl != "" {
+		icy(META_STREAMURL, m.StreamUrl)
+	}
+
+	for _, kv := range m.fields() {
+		switch kv[0] {
+		case META_STREAMTITLE, META_STREAMURL, META_ARTIST, META_TITLE:
+		default:
+			icy(kv[0], kv[1])
+		}
+	}
+
+	s := b.String()
+
+	// extra keys are dropped, then the title cut short, to fit a block
+	// - keeping StreamUrl, unless it wouldn't fit even with no title
+	if len(s) > MAX_ICY {
+		n := MAX_ICY - len("StreamTitle='';")
+
+		var url string
+		if m.StreamUrl != "" {
+			url = META_STREAMURL + "='" + clean.Replace(m.StreamUrl) + "';"
+		}
+
+		if len(url) > n {
+			url = ""
+		}
+		n -= len(url)
+
+		if len(title) > n {
+			for n > 0 && !utf8.RuneStart(title[n]) {
+				n-- // not part way through a character
+			}
+			title = title[:n]
+		}
+
+		b.Reset()
+		icy(META_STREAMTITLE, title)
+		b.WriteString(url)
+		s = b.String()
+	}
+
+	return []byte(s)
+}
+
+// ICYBlock renders the metadata as a complete ICY metadata block for
+// listeners: a length byte followed by the ICY string padded with
+// NULs to a multiple of 16 bytes
+func (m *Metadata) ICYBlock() []byte {
+	s := m.ICY()
+	n := (len(s) + 15) / 16
+
+	b := make([]byte, 1+n*16)
+	b[0] = byte(n)
+	copy(b[1:], s)
+
+	return b
+}
+
+// encoding for version 2 METADATA messages - "\r" and "\n" can't
+// appear in keys or values so are replaced with spaces
+func (m *Metadata) marshal() string {
+	clean := strings.NewReplacer("\r", " ", "\n", " ")
+
+	var pairs []string
+	for _, kv := range m.fields() {
+		pairs = append(pairs, clean.Replace(kv[0])+"\r"+clean.Replace(kv[1]))
+	}
+
+	return strings.Join(pairs, "\n")
+}
+
+func unmarshalMetadata(s string) Metadata {
+	var m Metadata
+
+	for _, pair := range strings.Split(s, "\n") {
+		if k, v, ok := strings.Cut(pair, "\r"); ok && k != "" {
+			m.Set(k, v)
+		}
+	}
+
+	return m
+}
@@ -0,0 +1,668 @@
+// Package protocol implements the davecast wire format described in
+// doc/protocol.txt - message encoding/decoding and the length
+// prefixed framing used over TCP.
+package protocol
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+)
+
+// message types
+const DATA = 0
+const METADATA = 1
+const ANNOUNCE = 2
+const HEADERS = 3
+const SUBSCRIBE = 4 // sent by edges to relays
+const NAK = 5       // sent by edges to relays to request retransmission
+const PARITY = 6    // forward error correction for a group of stream messages
+
+// SUBSCRIBE operations
+const SUB_ADD = 1
+const SUB_DEL = 2
+
+// most sequence numbers which may be requested in one NAK message
+const MAX_NAK = 256
+
+// audio types carried in version 1 ANNOUNCE messages
+const AAC_2C_44100_48000 = 0
+const MP3_2C_44100_128000 = 1
+const AAC_2C_44100_192000 = 2
+const AAC_2C_44100_128000 = 3
+const MP3_1C_44100_48000 = 4
+const AAC_2C_44100_24000 = 5
+
+// codecs carried in version 2 ANNOUNCE messages
+const CODEC_MP3 = 1
+const CODEC_AAC = 2
+
+// AAC profiles are MPEG-4 audio object types, MP3 profiles the layer
+const PROFILE_AAC_LC = 2
+const PROFILE_HE_AAC = 5
+const PROFILE_HE_AAC_V2 = 29
+const PROFILE_MP1 = 1
+const PROFILE_MP2 = 2
+const PROFILE_MP3 = 3
+
+// size of the codec descriptor (excluding its length byte)
+const CODEC_LENGTH = 11
+
+// version 2 headers start with a magic/version byte (0xd2) which
+// can't be mistaken for a v1 message type, followed by the header
+// length and a flags byte
+const MAGIC = 0xd0
+const V1_HEADER = 26
+const V2_HEADER = 30
+
+// offset of the hop count, incremented by each relay
+const HOPS = 29
+
+// v2 header flag - DATA message header is extended with the time the
+// encoder captured the frame (ns since 1970, 64 bit) and the number of
+// samples in the stream before it (64 bit)
+const FLAG_TIME = 0x02
+const TIMESTAMP = 30
+const V2_TIME_HEADER = 46
+
+// largest message which can be carried by the TCP framing
+const MAX_FRAME = 65535
+
+var (
+	ErrShort   = errors.New("protocol: message too short")
+	ErrVersion = errors.New("protocol: unsupported version")
+	ErrHeader  = errors.New("protocol: bad header length")
+	ErrType    = errors.New("protocol: unknown message type")
+	ErrUUID    = errors.New("protocol: bad uuid")
+	ErrTooLong = errors.New("protocol: message too long")
+	ErrCodec   = errors.New("protocol: bad codec descriptor")
+)
+
+type UUID [16]byte
+
+// RFC 4122
+func NewUUID() (UUID, error) {
+	var uuid UUID
+	if _, err := io.ReadFull(rand.Reader, uuid[:]); err != nil {
+		return uuid, err
+	}
+	uuid[8] = uuid[8]&^0xc0 | 0x80 // variants 4.1.1
+	uuid[6] = uuid[6]&^0xf0 | 0x40 // v4 4.1.3
+	return uuid, nil
+}
+
+func ParseUUID(s string) (UUID, error) {
+	var uuid UUID
+	if len(s) != 32 {
+		return uuid, ErrUUID
+	}
+	if _, err := hex.Decode(uuid[:], []byte(s)); err != nil {
+		return uuid, ErrUUID
+	}
+	return uuid, nil
+}
+
+func (u UUID) String() string {
+	return hex.EncodeToString(u[:])
+}
+
+// A PDU is a single davecast message. Only the fields relevant to
+// Type are encoded; messages of an unknown type are decoded with an
+// empty body so that sequence numbers can still be accounted for.
+type PDU struct {
+	Version int    // 1 or 2
+	Flags   uint8  // v2 header flags
+	KeyID   string // key which signed the message (FLAG_AUTH)
+	Hops    uint8  // number of relays traversed (v2 only)
+	Type    uint8  // DATA, METADATA, ANNOUNCE, HEADERS, SUBSCRIBE, NAK or PARITY
+	Replica uint8  // replica number from encoder
+	UUID    UUID   // unique stream id
+	Seq     uint64 // sequence number
+
+	Data       []byte   // DATA: ADTS/MPEG frame, PARITY: see FEC
+	Time       int64    // DATA: capture time, ns since 1970 (v2 only, 0 if not stamped)
+	Samples    uint64   // DATA: samples in the stream before this frame (with Time)
+	Metadata   Metadata // METADATA: what is playing
+	Codec      Codec    // ANNOUNCE: audio parameters
+	Mountpoint string   // ANNOUNCE: mountpoint name
+	Headers    string   // HEADERS: "key\rvalue\n..." pairs
+
+	Op       uint8    // SUBSCRIBE: SUB_ADD or SUB_DEL
+	Patterns []string // SUBSCRIBE: mountpoint names or path.Match patterns
+
+	Missing []uint64 // NAK: sequence numbers to retransmit
+	Group   []uint64 // PARITY: sequence numbers of the messages covered
+}
+
+func (p *PDU) header() int {
+	switch {
+	case p.Version == 2 && p.stamped():
+		return V2_TIME_HEADER
+	case p.Version == 2:
+		return V2_HEADER
+	}
+	return V1_HEADER
+}
+
+// whether the header carries the capture time - see FLAG_TIME
+func (p *PDU) stamped() bool {
+	return p.Type == DATA && p.Time != 0
+}
+
+// Marshal encodes the PDU in the version given by p.Version
+func (p *PDU) Marshal() ([]byte, error) {
+	var body int
+	var meta string
+
+	switch p.Type {
+	case DATA:
+		body = len(p.Data)
+	case METADATA:
+		if p.Version == 2 {
+			meta = p.Metadata.marshal()
+		} else {
+			meta = string(p.Metadata.ICY())
+		}
+		body = len(meta)
+	case ANNOUNCE:
+		body = 1 + len(p.Mountpoint)
+		if p.Version == 2 {
+			body += CODEC_LENGTH
+		}
+	case HEADERS:
+		body = len(p.Headers)
+	case SUBSCRIBE:
+		body = 1 + len(strings.Join(p.Patterns, "\n"))
+	case NAK:
+		if len(p.Missing) > MAX_NAK {
+			return nil, ErrTooLong
+		}
+		body = 8 * len(p.Missing)
+	case PARITY:
+		for _, g := range p.Group {
+			if g > p.Seq || p.Seq-g > MAX_GROUP {
+				return nil, ErrFEC
+			}
+		}
+		if len(p.Group) > MAX_GROUP || len(p.Data) < 3 {
+			return nil, ErrFEC
+		}
+		body = 1 + len(p.Group) + len(p.Data)
+	default:
+		return nil, ErrType
+	}
+
+	if p.Version != 1 && p.Version != 2 {
+		return nil, ErrVersion
+	}
+
+	h := p.header()
+
+	if h+body > MAX_FRAME {
+		return nil, ErrTooLong
+	}
+
+	buff := make([]byte, h+body)
+	b := buff
+
+	if p.Version == 2 {
+		b[0] = MAGIC | 2
+		b[1] = byte(h)
+		b[2] = p.Flags &^ (FLAG_AUTH | FLAG_TIME) // see Key.Sign
+		b[HOPS] = p.Hops
+
+		if p.stamped() {
+			b[2] |= FLAG_TIME
+			binary.BigEndian.PutUint64(b[TIMESTAMP:], uint64(p.Time))
+			binary.BigEndian.PutUint64(b[TIMESTAMP+8:], p.Samples)
+		}
+
+		b = b[3:]
+	}
+
+	b[0] = p.Type
+	b[1] = p.Replica
+	copy(b[2:18], p.UUID[:])
+	binary.BigEndian.PutUint64(b[18:26], p.Seq)
+
+	switch p.Type {
+	case DATA:
+		copy(buff[h:], p.Data)
+	case METADATA:
+		copy(buff[h:], meta)
+	case ANNOUNCE:
+		if p.Version == 2 {
+			buff[h] = CODEC_LENGTH
+			p.Codec.put(buff[h+1:])
+			copy(buff[h+1+CODEC_LENGTH:], p.Mountpoint)
+		} else {
+			buff[h] = p.Codec.Legacy()
+			copy(buff[h+1:], p.Mountpoint)
+		}
+	case HEADERS:
+		copy(buff[h:], p.Headers)
+	case SUBSCRIBE:
+		buff[h] = p.Op
+		copy(buff[h+1:], strings.Join(p.Patterns, "\n"))
+	case NAK:
+		for n, seq := range p.Missing {
+			binary.BigEndian.PutUint64(buff[h+8*n:], seq)
+		}
+	case PARITY:
+		buff[h] = byte(len(p.Group))
+		for n, g := range p.Group {
+			buff[h+1+n] = byte(p.Seq - g)
+		}
+		copy(buff[h+1+len(p.Group):], p.Data)
+	}
+
+	return buff, nil
+}
+
+// Unmarshal decodes a v1 or v2 message. DATA is not copied and so
+// refers to the underlying array of msg. Any HMAC trailer is removed
+// but not verified - see Keyring.Verify.
+func Unmarshal(msg []byte) (*PDU, error) {
+	var p PDU
+
+	n := len(msg)
+	h := V1_HEADER
+	b := msg
+
+	if n < 1 {
+		return nil, ErrShort
+	}
+
+	if msg[0]&0xf0 == MAGIC {
+		if msg[0]&0x0f != 2 {
+			return nil, ErrVersion
+		}
+
+		if n < 3 {
+			return nil, ErrShort
+		}
+
+		h = int(msg[1])
+
+		if h < V2_HEADER {
+			return nil, ErrHeader
+		}
+
+		if n < h {
+			return nil, ErrShort
+		}
+
+		p.Version = 2
+		p.Flags = msg[2]
+		b = msg[3:]
+		p.Hops = msg[HOPS]
+
+		if p.Flags&FLAG_TIME != 0 && h >= V2_TIME_HEADER {
+			p.Time = int64(binary.BigEndian.Uint64(msg[TIMESTAMP:]))
+			p.Samples = binary.BigEndian.Uint64(msg[TIMESTAMP+8:])
+		}
+	} else {
+		p.Version = 1
+	}
+
+	if n < h {
+		return nil, ErrShort
+	}
+
+	p.Type = b[0]
+	p.Replica = b[1]
+	copy(p.UUID[:], b[2:18])
+	p.Seq = binary.BigEndian.Uint64(b[18:26])
+
+	body := msg[h:]
+
+	if p.Flags&FLAG_AUTH != 0 {
+		id, l, err := trailer(msg, h)
+		if err != nil {
+			return nil, err
+		}
+		p.KeyID = id
+		body = msg[h : len(msg)-l]
+	}
+
+	if err := p.decode(body); err != nil {
+		return nil, err
+	}
+
+	return &p, nil
+}
+
+// decode sets the fields for the message type from the body
+func (p *PDU) decode(body []byte) error {
+	switch p.Type {
+	case DATA:
+		if len(body) < 2 {
+			return ErrShort
+		}
+		p.Data = body
+
+	case METADATA:
+		if p.Version == 2 {
+			p.Metadata = unmarshalMetadata(string(body))
+		} else {
+			p.Metadata = ParseICY(body)
+		}
+
+	case ANNOUNCE:
+		if len(body) < 1 {
+			return ErrShort
+		}
+
+		if p.Version == 1 {
+			p.Codec = LegacyCodec(body[0])
+			p.Mountpoint = string(body[1:])
+			break
+		}
+
+		// descriptor may grow - skip anything we don't understand
+		l := int(body[0])
+
+		if l < CODEC_LENGTH {
+			return ErrCodec
+		}
+
+		if len(body) < 1+l {
+			return ErrShort
+		}
+
+		p.Codec.get(body[1:])
+		p.Mountpoint = string(body[1+l:])
+
+	case HEADERS:
+		p.Headers = string(body)
+
+	case SUBSCRIBE:
+		if len(body) < 1 {
+			return ErrShort
+		}
+		p.Op = body[0]
+		if len(body) > 1 {
+			p.Patterns = strings.Split(string(body[1:]), "\n")
+		}
+
+	case NAK:
+		if len(body)%8 != 0 || len(body) > 8*MAX_NAK {
+			return ErrShort
+		}
+		for n := 0; n < len(body); n += 8 {
+			p.Missing = append(p.Missing, binary.BigEndian.Uint64(body[n:]))
+		}
+
+	case PARITY:
+		if len(body) < 1 || len(body) < 1+int(body[0])+3 {
+			return ErrShort
+		}
+		for _, d := range body[1 : 1+body[0]] {
+			if uint64(d) > p.Seq {
+				return ErrFEC
+			}
+			p.Group = append(p.Group, p.Seq-uint64(d))
+		}
+		p.Data = body[1+body[0]:]
+	}
+
+	return nil
+}
+
+// Body returns the encoded message body (without the header)
+func (p *PDU) Body() ([]byte, error) {
+	b, err := p.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	return b[p.header():], nil
+}
+
+// Hop returns a copy of a message with the hop count incremented, or
+// false if it has already traversed max relays. Version 1 messages,
+// which have no hop count, are returned unchanged.
+func Hop(msg []byte, max uint8) ([]byte, bool) {
+	if len(msg) < V2_HEADER || msg[0]&0xf0 != MAGIC {
+		return msg, true
+	}
+
+	if msg[HOPS] >= max {
+		return nil, false
+	}
+
+	b := make([]byte, len(msg))
+	copy(b, msg)
+	b[HOPS]++
+
+	return b, true
+}
+
+// Match reports whether a mountpoint matches any of a list of names
+// or path.Match patterns
+func Match(patterns []string, mountpoint string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, mountpoint); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Codec describes the audio carried by a stream
+type Codec struct {
+	Codec      uint8  // CODEC_AAC or CODEC_MP3
+	Profile    uint8  // audio object type (AAC) or layer (MP3)
+	Channels   uint8  // number of channels
+	SampleRate uint32 // Hz
+	Bitrate    uint32 // bits per second (average for VBR)
+}
+
+var legacy = []Codec{
+	AAC_2C_44100_48000:  {CODEC_AAC, PROFILE_AAC_LC, 2, 44100, 48000},
+	MP3_2C_44100_128000: {CODEC_MP3, PROFILE_MP3, 2, 44100, 128000},
+	AAC_2C_44100_192000: {CODEC_AAC, PROFILE_AAC_LC, 2, 44100, 192000},
+	AAC_2C_44100_128000: {CODEC_AAC, PROFILE_AAC_LC, 2, 44100, 128000},
+	MP3_1C_44100_48000:  {CODEC_MP3, PROFILE_MP3, 1, 44100, 48000},
+	AAC_2C_44100_24000:  {CODEC_AAC, PROFILE_AAC_LC, 2, 44100, 24000},
+}
+
+// LegacyCodec converts a version 1 audio type; unknown types are
+// assumed to be AAC 48k as IcecastServer always has done
+func LegacyCodec(atype uint8) Codec {
+	if int(atype) < len(legacy) {
+		return legacy[atype]
+	}
+	return legacy[AAC_2C_44100_48000]
+}
+
+// Legacy returns the version 1 audio type which matches the codec
+// (the profile was never distinguished). Codecs with no equivalent
+// are sent as MP3 128k, which is what the encoders have always done
+// - use version 2 for these.
+func (c Codec) Legacy() uint8 {
+	t, _ := c.legacy()
+	return t
+}
+
+// HasLegacy reports whether the codec can be sent in a version 1
+// ANNOUNCE message
+func (c Codec) HasLegacy() bool {
+	_, ok := c.legacy()
+	return ok
+}
+
+func (c Codec) legacy() (uint8, bool) {
+	for n, l := range legacy {
+		if l.Codec == c.Codec && l.Channels == c.Channels &&
+			l.SampleRate == c.SampleRate && l.Bitrate == c.Bitrate {
+			return uint8(n), true
+		}
+	}
+	return MP3_2C_44100_128000, false
+}
+
+func (c Codec) put(b []byte) {
+	b[0] = c.Codec
+	b[1] = c.Profile
+	b[2] = c.Channels
+	binary.BigEndian.PutUint32(b[3:7], c.SampleRate)
+	binary.BigEndian.PutUint32(b[7:11], c.Bitrate)
+}
+
+func (c *Codec) get(b []byte) {
+	c.Codec = b[0]
+	c.Profile = b[1]
+	c.Channels = b[2]
+	c.SampleRate = binary.BigEndian.Uint32(b[3:7])
+	c.Bitrate = binary.BigEndian.Uint32(b[7:11])
+}
+
+// ContentType returns the MIME type used by Icecast for the codec
+func (c Codec) ContentType() string {
+	if c.Codec == CODEC_MP3 {
+		return "audio/mpeg"
+	}
+	return "audio/aacp"
+}
+
+// FrameSamples returns the samples carried by each frame: 1024 for
+// AAC (2048 for HE-AAC, whose SampleRate is the output rate), 1152 for
+// MP3 (576 below 32kHz) and 384 for layer 1. 0 if unknown.
+func (c Codec) FrameSamples() uint32 {
+	switch {
+	case c.Codec == CODEC_AAC && (c.Profile == PROFILE_HE_AAC || c.Profile == PROFILE_HE_AAC_V2):
+		return 2048
+	case c.Codec == CODEC_AAC:
+		return 1024
+	case c.Codec == CODEC_MP3 && c.Profile == PROFILE_MP1:
+		return 384
+	case c.Codec == CODEC_MP3 && c.Profile == PROFILE_MP3 && c.SampleRate < 32000:
+		return 576
+	case c.Codec == CODEC_MP3:
+		return 1152
+	}
+	return 0
+}
+
+// FrameDuration returns the audio carried by each frame, and so the
+// cadence at which a stream's DATA messages are expected. 0 if unknown.
+func (c Codec) FrameDuration() time.Duration {
+	if c.SampleRate == 0 {
+		return 0
+	}
+	return time.Duration(c.FrameSamples()) * time.Second / time.Duration(c.SampleRate)
+}
+
+// Kbps returns the bitrate rounded to the nearest kilobit
+func (c Codec) Kbps() int {
+	return int((c.Bitrate + 500) / 1000)
+}
+
+func (c Codec) String() string {
+	name := "UNK"
+
+	switch {
+	case c.Codec == CODEC_MP3:
+		name = "MP3"
+	case c.Codec == CODEC_AAC && c.Profile == PROFILE_HE_AAC:
+		name = "HE-AAC"
+	case c.Codec == CODEC_AAC && c.Profile == PROFILE_HE_AAC_V2:
+		name = "HE-AACv2"
+	case c.Codec == CODEC_AAC:
+		name = "AAC"
+	}
+
+	return fmt.Sprintf("%s_%dC_%d_%d", name, c.Channels, c.SampleRate, c.Bitrate)
+}
+
+// Reader reads length prefixed messages from a TCP stream
+type Reader struct {
+	r *bufio.Reader
+}
+
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: bufio.NewReader(r)}
+}
+
+// ReadFrame returns the next message, skipping zero length frames
+func (r *Reader) ReadFrame() ([]byte, error) {
+	var size [2]byte
+
+	for {
+		if _, err := io.ReadFull(r.r, size[:]); err != nil {
+			return nil, err
+		}
+
+		length := int(size[0])<<8 + int(size[1])
+
+		if length == 0 {
+			continue
+		}
+
+		buff := make([]byte, length)
+
+		if _, err := io.ReadFull(r.r, buff); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+
+		return buff, nil
+	}
+}
+
+func (r *Reader) ReadPDU() (*PDU, error) {
+	if b, err := r.ReadFrame(); err != nil {
+		return nil, err
+	} else {
+		return Unmarshal(b)
+	}
+}
+
+// Writer writes length prefixed messages to a TCP stream
+type Writer struct {
+	w io.Writer
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+// WriteFrame writes the length and message with a single call to
+// the underlying writer
+func (w *Writer) WriteFrame(msg []byte) error {
+	l := len(msg)
+
+	if l > MAX_FRAME {
+		return ErrTooLong
+	}
+
+	b := make([]byte, l+2)
+	b[0] = byte(l >> 8)
+	b[1] = byte(l & 0xff)
+	copy(b[2:], msg)
+
+	if n, err := w.w.Write(b); err != nil {
+		return err
+	} else if n != len(b) {
+		return io.ErrShortWrite
+	}
+
+	return nil
+}
+
+func (w *Writer) WritePDU(p *PDU) error {
+	if b, err := p.Marshal(); err != nil {
+		return err
+	} else {
+		return w.WriteFrame(b)
+	}
+}
@@ -0,0 +1,603 @@
+package protocol
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func testPDUs() []PDU {
+	uuid, _ := ParseUUID("0123456789abcdef0123456789abcdef")
+
+	return []PDU{
+		{Type: DATA, Replica: 1, UUID: uuid, Seq: 1, Data: []byte{0xff, 0xf1, 0x50, 0x80}},
+		{Type: METADATA, Replica: 2, UUID: uuid, Seq: 2, Metadata: Metadata{StreamTitle: "x"}},
+		{Type: ANNOUNCE, UUID: uuid, Seq: 3, Codec: LegacyCodec(MP3_2C_44100_128000), Mountpoint: "Capital"},
+		{Type: HEADERS, UUID: uuid, Seq: 1 << 40, Headers: "Icy-Name\rCapital FM\nIcy-Genre\rPop"},
+		{Type: SUBSCRIBE, Op: SUB_ADD, Patterns: []string{"Capital", "Heart*"}},
+		{Type: SUBSCRIBE, Op: SUB_DEL},
+		{Type: NAK, UUID: uuid, Missing: []uint64{41, 43, 1 << 40}},
+		{Type: PARITY, UUID: uuid, Seq: 300, Group: []uint64{45, 46, 300}, Data: []byte{0, 0, 1, 0xff}},
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, version := range []int{1, 2} {
+		for _, p := range testPDUs() {
+			p.Version = version
+
+			b, err := p.Marshal()
+			if err != nil {
+				t.Fatalf("v%d type %d: marshal: %v", version, p.Type, err)
+			}
+
+			q, err := Unmarshal(b)
+			if err != nil {
+				t.Fatalf("v%d type %d: unmarshal: %v", version, p.Type, err)
+			}
+
+			if !reflect.DeepEqual(&p, q) {
+				t.Errorf("v%d type %d: got %+v, want %+v", version, p.Type, q, p)
+			}
+		}
+	}
+}
+
+func TestV1Layout(t *testing.T) {
+	p := testPDUs()[2]
+	p.Version = 1
+	b, _ := p.Marshal()
+
+	if len(b) != V1_HEADER+1+len("Capital") || b[0] != ANNOUNCE || b[26] != MP3_2C_44100_128000 {
+		t.Errorf("unexpected v1 encoding % x", b)
+	}
+}
+
+func TestCodec(t *testing.T) {
+	c := Codec{Codec: CODEC_AAC, Profile: PROFILE_HE_AAC_V2, Channels: 2, SampleRate: 22050, Bitrate: 32000}
+	p := PDU{Version: 2, Type: ANNOUNCE, Codec: c, Mountpoint: "Heart"}
+
+	b, _ := p.Marshal()
+	q, err := Unmarshal(b)
+
+	if err != nil || q.Codec != c || q.Mountpoint != "Heart" {
+		t.Errorf("got %+v %v, want %+v", q, err, c)
+	}
+
+	if c.HasLegacy() || c.Legacy() != MP3_2C_44100_128000 {
+		t.Errorf("%v should have no v1 audio type", c)
+	}
+
+	// a longer descriptor from a future encoder must be skipped
+	ext := append([]byte{}, b[:V2_HEADER+1+CODEC_LENGTH]...)
+	ext = append(ext, 0xaa)
+	ext = append(ext, "Heart"...)
+	ext[V2_HEADER]++
+
+	if q, err := Unmarshal(ext); err != nil || q.Codec != c || q.Mountpoint != "Heart" {
+		t.Errorf("got %+v %v from extended descriptor", q, err)
+	}
+
+	ext[V2_HEADER] = CODEC_LENGTH - 1
+
+	if _, err := Unmarshal(ext); err != ErrCodec {
+		t.Errorf("short descriptor: got %v, want ErrCodec", err)
+	}
+
+	for n := uint8(0); n <= AAC_2C_44100_24000; n++ {
+		if l := LegacyCodec(n); !l.HasLegacy() || l.Legacy() != n {
+			t.Errorf("legacy type %d: got %v", n, l)
+		}
+	}
+
+	if c := LegacyCodec(AAC_2C_44100_192000); c.ContentType() != "audio/aacp" || c.Kbps() != 192 {
+		t.Errorf("got %v %s %d", c, c.ContentType(), c.Kbps())
+	}
+}
+
+func TestFrameDuration(t *testing.T) {
+	for _, f := range []struct {
+		c Codec
+		d time.Duration
+	}{
+		{LegacyCodec(AAC_2C_44100_48000), 23219954},
+		{LegacyCodec(MP3_2C_44100_128000), 26122448},
+		{Codec{CODEC_AAC, PROFILE_HE_AAC, 2, 48000, 64000}, 42666666},
+		{Codec{CODEC_MP3, PROFILE_MP3, 1, 22050, 32000}, 26122448},
+		{Codec{CODEC_MP3, 1, 2, 48000, 384000}, 8 * time.Millisecond},
+		{Codec{CODEC_AAC, PROFILE_AAC_LC, 2, 0, 0}, 0},
+		{Codec{}, 0},
+	} {
+		if d := f.c.FrameDuration(); d != f.d {
+			t.Errorf("%v: got %v, want %v", f.c, d, f.d)
+		}
+	}
+}
+
+func TestV2LongerHeader(t *testing.T) {
+	p := testPDUs()[0]
+	p.Version = 2
+	b, _ := p.Marshal()
+
+	// a future header with two extra bytes must still decode
+	ext := append([]byte{}, b[:V2_HEADER]...)
+	ext = append(ext, 0xaa, 0xbb)
+	ext = append(ext, b[V2_HEADER:]...)
+	ext[1] = V2_HEADER + 2
+
+	q, err := Unmarshal(ext)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(q.Data, p.Data) {
+		t.Errorf("got data % x, want % x", q.Data, p.Data)
+	}
+}
+
+func TestTimestamp(t *testing.T) {
+	p := testPDUs()[0]
+	p.Version = 2
+	p.Time = time.Date(2016, 6, 1, 12, 0, 0, 500, time.UTC).UnixNano()
+	p.Samples = 1 << 33
+
+	b, err := p.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(b) != V2_TIME_HEADER+len(p.Data) || b[1] != V2_TIME_HEADER || b[2] != FLAG_TIME {
+		t.Errorf("unexpected encoding % x", b)
+	}
+
+	q, err := Unmarshal(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p.Flags = FLAG_TIME
+	if !reflect.DeepEqual(&p, q) {
+		t.Errorf("got %+v, want %+v", q, p)
+	}
+
+	// the flag is ignored if the header is too short to hold them
+	short := append(append([]byte{}, b[:V2_HEADER]...), p.Data...)
+	short[1] = V2_HEADER
+
+	if q, err := Unmarshal(short); err != nil || q.Time != 0 || !bytes.Equal(q.Data, p.Data) {
+		t.Errorf("short header: got %+v %v", q, err)
+	}
+
+	// only DATA is stamped, and version 1 has nowhere to put it
+	m := testPDUs()[1]
+	m.Version, m.Time = 2, p.Time
+
+	if b, _ := m.Marshal(); b[1] != V2_HEADER || b[2] != 0 {
+		t.Errorf("metadata stamped % x", b)
+	}
+
+	p.Version = 1
+	if b, _ := p.Marshal(); len(b) != V1_HEADER+len(p.Data) {
+		t.Errorf("v1 stamped % x", b)
+	}
+}
+
+func TestHops(t *testing.T) {
+	p := testPDUs()[0]
+	p.Version = 2
+	b, _ := p.Marshal()
+
+	for n := 1; n <= 3; n++ {
+		var ok bool
+		if b, ok = Hop(b, 3); !ok {
+			t.Fatalf("hop %d refused", n)
+		}
+	}
+
+	if q, _ := Unmarshal(b); q.Hops != 3 {
+		t.Errorf("got %d hops, want 3", q.Hops)
+	}
+
+	if _, ok := Hop(b, 3); ok {
+		t.Errorf("hop limit not enforced")
+	}
+
+	p.Version = 1
+	v1, _ := p.Marshal()
+
+	if h, ok := Hop(v1, 3); !ok || !bytes.Equal(h, v1) {
+		t.Errorf("version 1 message changed")
+	}
+}
+
+func TestMalformed(t *testing.T) {
+	p := testPDUs()[0]
+	p.Version = 2
+	v2, _ := p.Marshal()
+
+	short := append([]byte{}, v2...)
+	short[1] = V2_HEADER - 1
+
+	long := append([]byte{}, v2...)
+	long[1] = 200
+
+	unknown := append([]byte{}, v2...)
+	unknown[0] = MAGIC | 3
+
+	nak := PDU{Version: 2, Type: NAK, Missing: []uint64{1}}
+	partial, _ := nak.Marshal()
+	partial = partial[:len(partial)-3]
+
+	cases := []struct {
+		name string
+		msg  []byte
+		err  error
+	}{
+		{"empty", []byte{}, ErrShort},
+		{"v1 truncated header", make([]byte, V1_HEADER-1), ErrShort},
+		{"v1 data without frame", make([]byte, V1_HEADER+1), ErrShort},
+		{"v2 truncated", v2[:2], ErrShort},
+		{"v2 header length too small", short, ErrHeader},
+		{"v2 header length past end", long, ErrShort},
+		{"unknown version", unknown, ErrVersion},
+		{"nak with partial sequence number", partial, ErrShort},
+	}
+
+	for _, c := range cases {
+		if _, err := Unmarshal(c.msg); err != c.err {
+			t.Errorf("%s: got %v, want %v", c.name, err, c.err)
+		}
+	}
+}
+
+func TestMarshalErrors(t *testing.T) {
+	p := PDU{Version: 1, Type: 99}
+	if _, err := p.Marshal(); err != ErrType {
+		t.Errorf("unknown type: got %v", err)
+	}
+
+	p = PDU{Version: 3, Type: DATA, Data: []byte{1, 2}}
+	if _, err := p.Marshal(); err != ErrVersion {
+		t.Errorf("unknown version: got %v", err)
+	}
+
+	p = PDU{Version: 1, Type: DATA, Data: make([]byte, MAX_FRAME)}
+	if _, err := p.Marshal(); err != ErrTooLong {
+		t.Errorf("oversize: got %v", err)
+	}
+
+	p = PDU{Version: 2, Type: NAK, Missing: make([]uint64, MAX_NAK+1)}
+	if _, err := p.Marshal(); err != ErrTooLong {
+		t.Errorf("oversize nak: got %v", err)
+	}
+}
+
+func TestUnknownType(t *testing.T) {
+	msg := make([]byte, V1_HEADER+4)
+	msg[0] = 42
+	msg[25] = 7
+
+	p, err := Unmarshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if p.Type != 42 || p.Seq != 7 {
+		t.Errorf("got type %d seq %d", p.Type, p.Seq)
+	}
+}
+
+func TestFraming(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+
+	for _, p := range testPDUs() {
+		p.Version = 2
+		if err := w.WritePDU(&p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	buf.Write([]byte{0, 0}) // keepalive
+
+	r := NewReader(&buf)
+
+	for _, p := range testPDUs() {
+		p.Version = 2
+		q, err := r.ReadPDU()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(&p, q) {
+			t.Errorf("got %+v, want %+v", q, p)
+		}
+	}
+
+	if _, err := r.ReadFrame(); err != io.EOF {
+		t.Errorf("got %v, want EOF", err)
+	}
+
+	if err := w.WriteFrame(make([]byte, MAX_FRAME+1)); err != ErrTooLong {
+		t.Errorf("oversize frame: got %v", err)
+	}
+}
+
+func TestTruncatedFrame(t *testing.T) {
+	r := NewReader(bytes.NewReader([]byte{0, 10, 1, 2, 3}))
+
+	if _, err := r.ReadFrame(); err != io.ErrUnexpectedEOF {
+		t.Errorf("got %v, want ErrUnexpectedEOF", err)
+	}
+}
+
+func TestUUID(t *testing.T) {
+	u, err := NewUUID()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v, err := ParseUUID(u.String())
+	if err != nil || v != u {
+		t.Errorf("got %v %v, want %v", v, err, u)
+	}
+
+	if _, err := ParseUUID("xyz"); err != ErrUUID {
+		t.Errorf("got %v, want ErrUUID", err)
+	}
+}
+
+func TestAuth(t *testing.T) {
+	key := &Key{ID: "capital", Secret: []byte("s3cret"), Mountpoints: []string{"Capital*"}}
+	other := &Key{ID: "heart", Secret: []byte("other")}
+	keys := Keyring{key.ID: key, other.ID: other}
+
+	p := testPDUs()[2]
+	p.Version = 2
+	b, _ := p.Marshal()
+
+	if _, err := keys.Verify(b); err != ErrNoAuth {
+		t.Errorf("unsigned: got %v, want ErrNoAuth", err)
+	}
+
+	signed, err := key.Sign(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q, k, err := keys.Authorize(signed)
+	if err != nil || k != key || q.KeyID != "capital" || q.Mountpoint != "Capital" {
+		t.Fatalf("got %+v %v %v", q, k, err)
+	}
+
+	// decoding without verifying must still strip the trailer
+	if q, err := Unmarshal(signed); err != nil || q.Mountpoint != "Capital" {
+		t.Errorf("got %+v %v", q, err)
+	}
+
+	// relays change the hop count
+	if hopped, _ := Hop(signed, 8); hopped[HOPS] != 1 {
+		t.Errorf("hop count not incremented")
+	} else if _, err := keys.Verify(hopped); err != nil {
+		t.Errorf("hopped: got %v", err)
+	}
+
+	tampered := append([]byte{}, signed...)
+	tampered[V2_HEADER+CODEC_LENGTH+2] ^= 1
+	if _, err := keys.Verify(tampered); err != ErrAuth {
+		t.Errorf("tampered: got %v, want ErrAuth", err)
+	}
+
+	forged := append([]byte{}, signed...)
+	copy(forged[len(forged)-MAC_LENGTH:], make([]byte, MAC_LENGTH))
+	if _, err := keys.Verify(forged); err != ErrAuth {
+		t.Errorf("forged: got %v, want ErrAuth", err)
+	}
+
+	if _, err := (Keyring{other.ID: other}).Verify(signed); err != ErrKey {
+		t.Errorf("unknown key: got %v, want ErrKey", err)
+	}
+
+	p.Mountpoint = "Heart"
+	b, _ = p.Marshal()
+	signed, _ = key.Sign(b)
+	if _, _, err := keys.Authorize(signed); err != ErrMount {
+		t.Errorf("hijack: got %v, want ErrMount", err)
+	}
+
+	p.Version = 1
+	b, _ = p.Marshal()
+	if _, err := key.Sign(b); err != ErrVersion {
+		t.Errorf("v1: got %v, want ErrVersion", err)
+	}
+
+	if _, err := Unmarshal(signed[:V2_HEADER+2]); err != ErrShort {
+		t.Errorf("truncated trailer: got %v, want ErrShort", err)
+	}
+}
+
+func TestOwners(t *testing.T) {
+	key := &Key{ID: "capital", Secret: []byte("s3cret")}
+	other := &Key{ID: "heart", Secret: []byte("other")} // any mountpoint
+	owners := NewOwners(Keyring{key.ID: key, other.ID: other})
+
+	sign := func(p PDU, k *Key) []byte {
+		p.Version = 2
+		b, _ := p.Marshal()
+		b, _ = k.Sign(b)
+		return b
+	}
+
+	pdus := testPDUs()
+	data, announce := pdus[0], pdus[2]
+
+	for n, x := range []struct {
+		msg []byte
+		err error
+	}{
+		{sign(data, key), ErrAnnounce}, // not yet bound
+		{sign(announce, key), nil},
+		{sign(data, key), nil},
+		{sign(data, other), ErrOwner},
+		{sign(announce, other), ErrOwner},
+		{sign(pdus[7], other), ErrOwner}, // parity too
+		{sign(pdus[6], other), nil},      // NAKs are not part of the stream
+	} {
+		if _, _, err := owners.Authorize(x.msg); err != x.err {
+			t.Errorf("%d: got %v, want %v", n, err, x.err)
+		}
+	}
+
+	owners.Expire(time.Now().Add(time.Second))
+
+	if _, _, err := owners.Authorize(sign(announce, other)); err != nil {
+		t.Errorf("after expiry: got %v", err)
+	}
+}
+
+func TestFEC(t *testing.T) {
+	uuid, _ := NewUUID()
+	fec := NewFEC(5)
+
+	var group []*PDU
+	var parity *PDU
+
+	for seq := uint64(10); parity == nil; seq++ {
+		p := &PDU{Version: 2, Type: DATA, UUID: uuid, Seq: seq}
+
+		switch seq % 4 {
+		case 1:
+			p.Type = METADATA
+			p.Metadata = Metadata{StreamTitle: "x"}
+		case 2:
+			p.Type = ANNOUNCE
+			p.Codec = LegacyCodec(AAC_2C_44100_48000)
+			p.Mountpoint = "Capital"
+		default:
+			p.Data = bytes.Repeat([]byte{byte(seq)}, int(seq))
+		}
+
+		group = append(group, p)
+		parity = fec.Add(p)
+	}
+
+	b, err := parity.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parity, err = Unmarshal(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(parity.Group, []uint64{10, 11, 12, 13, 14}) || parity.Seq != 14 {
+		t.Fatalf("unexpected group %v seq %d", parity.Group, parity.Seq)
+	}
+
+	for lost := range group {
+		var others []*PDU
+		for n, p := range group {
+			if n != lost {
+				others = append(others, p)
+			}
+		}
+
+		p, err := Recover(parity, others)
+		if err != nil || !reflect.DeepEqual(p, group[lost]) {
+			t.Errorf("recover %d: got %+v, %v", lost, p, err)
+		}
+	}
+
+	if _, err := Recover(parity, group[2:]); err != ErrFEC {
+		t.Errorf("two missing: got %v", err)
+	}
+
+	p := PDU{Version: 2, Type: PARITY, Seq: 1000, Group: []uint64{1, 1000}, Data: []byte{0, 0, 0}}
+	if _, err := p.Marshal(); err != ErrFEC {
+		t.Errorf("group too wide: got %v", err)
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	icy := []byte("StreamTitle='Guns N' Roses - Don't Cry';StreamUrl='';adw_ad='true';\x00\x00\x00")
+
+	m := ParseICY(icy)
+	want := Metadata{StreamTitle: "Guns N' Roses - Don't Cry", Artist: "Guns N' Roses",
+		Title: "Don't Cry", Extra: map[string]string{"adw_ad": "true"}}
+
+	if !reflect.DeepEqual(m, want) {
+		t.Fatalf("parse: got %#v", m)
+	}
+
+	if s := string(m.ICY()); s != "StreamTitle='Guns N' Roses - Don't Cry';adw_ad='true';" {
+		t.Errorf("render: got %q", s)
+	}
+
+	// StreamTitle made from artist and title, and always sent
+	for _, c := range []struct {
+		m   Metadata
+		icy string
+	}{
+		{Metadata{Artist: "A", Title: "B"}, "StreamTitle='A - B';"},
+		{Metadata{Title: "B", StreamUrl: "http://x/"}, "StreamTitle='B';StreamUrl='http://x/';"},
+		{Metadata{StreamTitle: "it';s\x00"}, "StreamTitle='it' ;s';"},
+		{Metadata{}, "StreamTitle='';"},
+	} {
+		if s := string(c.m.ICY()); s != c.icy {
+			t.Errorf("render %#v: got %q, want %q", c.m, s, c.icy)
+		}
+	}
+
+	b := (&Metadata{StreamTitle: "x"}).ICYBlock()
+	if len(b) != 17 || b[0] != 1 || string(bytes.TrimRight(b[1:], "\x00")) != "StreamTitle='x';" {
+		t.Errorf("block: got %q", b)
+	}
+
+	long := Metadata{StreamTitle: string(bytes.Repeat([]byte("x"), 5000)),
+		Extra: map[string]string{"a": "b"}}
+	if b := long.ICYBlock(); len(b) != 1+MAX_ICY || b[0] != 255 {
+		t.Errorf("long block: length %d", len(b))
+	}
+
+	// cut short on a character boundary, leaving the block valid UTF-8
+	long = Metadata{StreamTitle: strings.Repeat("é", 3000)}
+	if b := long.ICYBlock(); !utf8.Valid(bytes.TrimRight(b[1:], "\x00")) || len(b) != 1+MAX_ICY {
+		t.Errorf("long block: not cut on a character boundary")
+	}
+
+	// StreamUrl is kept, the title cut to the space left
+	long = Metadata{StreamTitle: strings.Repeat("x", 5000), StreamUrl: "http://x/",
+		Extra: map[string]string{"a": "b"}}
+	if s := string(long.ICY()); len(s) != MAX_ICY || !strings.HasSuffix(s, "';StreamUrl='http://x/';") {
+		t.Errorf("long with url: got %d bytes ending %q", len(s), s[len(s)-30:])
+	}
+
+	// unless it wouldn't fit with any title
+	long.StreamUrl = strings.Repeat("u", MAX_ICY)
+	if s := string(long.ICY()); len(s) != MAX_ICY || strings.Contains(s, "StreamUrl") {
+		t.Errorf("long url: got %d bytes", len(s))
+	}
+
+	// version 2 carries every field
+	p := PDU{Version: 2, Type: METADATA, Metadata: Metadata{StreamTitle: "T", Artist: "A\nB",
+		Title: "C", StreamUrl: "u", Extra: map[string]string{"k": "v"}}}
+
+	msg, err := p.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q, err := Unmarshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p.Metadata.Artist = "A B"
+	if !reflect.DeepEqual(q.Metadata, p.Metadata) {
+		t.Errorf("v2: got %#v", q.Metadata)
+	}
+}
@@ -56,6 +56,16 @@ func (r *Ring) Head ()(arbitrary, bool) {
 	return v, true
 }
 
+// the nth item from the oldest, without removing it
+func (r *Ring) At (n int)(arbitrary) {
+	if n < 0 || n >= r.items {
+		return nil
+	}
+
+	v := r.arr[(r.start + n) % r.size]
+	return v
+}
+
 func (r *Ring) Peek ()(arbitrary) {
 	if r.items == 0 {
 		return nil
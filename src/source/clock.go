@@ -0,0 +1,58 @@
+package source
+
+import (
+	"time"
+
+	"protocol"
+)
+
+// a frame read this much later than its stamp means audio was lost
+// upstream (eg. the source reconnected to Icecast), so the stream
+// no longer follows on from where the clock was anchored
+const SLIP = 2 * time.Second
+
+// Clock stamps frames with their capture time: when the stream
+// started plus the duration of the audio before them, so that stamps
+// advance by exactly a frame rather than with the jitter of when
+// frames happen to be read. The start is taken as early as the frames
+// read so far allow, as a burst (eg. Icecast's backlog for new
+// listeners) arrives faster than it was captured.
+type Clock struct {
+	anchor  int64  // ns since 1970 of the first sample since base
+	base    uint64 // samples before the anchor
+	rate    uint32
+	started bool
+}
+
+// Stamp returns the capture time of the frame after samples, read at
+// read (ns since 1970) - or 0 (not stamped) if the codec's sample rate
+// or frame size is not known
+func (c *Clock) Stamp(read int64, samples uint64, codec protocol.Codec) int64 {
+	rate := codec.SampleRate
+	if rate == 0 || codec.FrameSamples() == 0 {
+		return 0
+	}
+
+	if !c.started || rate != c.rate || samples < c.base {
+		c.anchor, c.base, c.rate, c.started = read, samples, rate, true
+	}
+
+	pts := c.anchor + offset(samples-c.base, rate)
+
+	switch {
+	case pts > read: // read sooner than ever, so started earlier
+		c.anchor -= pts - read
+		pts = read
+	case read-pts > int64(SLIP): // a discontinuity
+		c.anchor, c.base = read, samples
+		pts = read
+	}
+
+	return pts
+}
+
+// duration of samples in ns, without overflowing for long streams
+func offset(samples uint64, rate uint32) int64 {
+	r := uint64(rate)
+	return int64(samples/r)*int64(time.Second) + int64(samples%r*uint64(time.Second)/r)
+}
@@ -0,0 +1,70 @@
+package source
+
+import (
+	"testing"
+	"time"
+
+	"protocol"
+)
+
+func TestClock(t *testing.T) {
+	const rate, frame = 48000, 1024
+	aac := protocol.Codec{Codec: protocol.CODEC_AAC, Profile: protocol.PROFILE_AAC_LC, SampleRate: rate}
+	d := int64(frame * time.Second / rate) // 21.333ms
+
+	var c Clock
+	start := time.Now().UnixNano()
+
+	// a second's backlog read all at once, then frames as captured
+	// with up to 10ms of jitter
+	var last, read int64
+	for n := 0; n < 200; n++ {
+		captured := start + offset(uint64((n-47)*frame), rate)
+		if n < 47 {
+			captured = start
+		}
+		if r := captured + int64(n%3)*int64(5*time.Millisecond); r > read {
+			read = r
+		}
+
+		pts := c.Stamp(read, uint64(n*frame), aac)
+
+		if pts < last || pts > read {
+			t.Fatalf("frame %d: stamped %d after %d, read %d", n, pts-start, last-start, read-start)
+		}
+
+		if n > 50 && pts-last != d && pts-last != d+1 {
+			t.Errorf("frame %d: advanced %v", n, time.Duration(pts-last))
+		}
+
+		last = pts
+	}
+
+	// as if the backlog had been read as it was captured
+	if want := start - 47*d; c.anchor < want-int64(time.Millisecond) || c.anchor > want+int64(time.Millisecond) {
+		t.Errorf("anchored %v from the start", time.Duration(c.anchor-start))
+	}
+
+	// three seconds of audio lost - stamps carry on from the read time
+	read = last + d + int64(3*time.Second)
+	if pts := c.Stamp(read, 200*frame, aac); pts != read {
+		t.Errorf("after a gap: stamped %v before read", time.Duration(read-pts))
+	}
+
+	if pts := c.Stamp(read+d, 201*frame, aac); pts != read+d {
+		t.Errorf("after the gap: stamped %v before read", time.Duration(read+d-pts))
+	}
+
+	if pts := c.Stamp(read, 202*frame, protocol.Codec{Codec: protocol.CODEC_AAC}); pts != 0 {
+		t.Error("stamped with no sample rate")
+	}
+}
+
+func TestOffset(t *testing.T) {
+	// 100 days of 44.1kHz audio would overflow samples * 1e9
+	samples := uint64(100 * 24 * 3600 * 44100)
+
+	if o := offset(samples+22050, 44100); o != int64(100*24*time.Hour+500*time.Millisecond) {
+		t.Errorf("got %v", time.Duration(o))
+	}
+}
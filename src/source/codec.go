@@ -0,0 +1,34 @@
+package source
+
+import (
+	"adts"
+	"protocol"
+)
+
+// Probed returns the codec of the frames a Probe has examined, less
+// the bitrate. SBR (and PS) signalled implicitly in ADTS make HE-AAC
+// (v2) frames look like AAC-LC at half the sample rate (and mono), so
+// HE-AAC is only taken where the sample rate (and channels) given by
+// the Ice-Audio-Info header in ice (0 if not given) show it - not from
+// an audio/aacp Content-Type, which many AAC-LC streams have.
+func Probed(info adts.Info, ice protocol.Codec) protocol.Codec {
+	c := protocol.Codec{Codec: protocol.CODEC_MP3, Profile: uint8(info.Profile),
+		Channels: uint8(info.Channels), SampleRate: uint32(info.SampleRate)}
+
+	if !info.AAC {
+		return c
+	}
+
+	c.Codec = protocol.CODEC_AAC
+
+	if c.Profile == protocol.PROFILE_AAC_LC && ice.SampleRate != 0 && c.SampleRate*2 == ice.SampleRate {
+		c.SampleRate = ice.SampleRate
+		c.Profile = protocol.PROFILE_HE_AAC
+		if c.Channels == 1 && ice.Channels == 2 {
+			c.Channels = 2
+			c.Profile = protocol.PROFILE_HE_AAC_V2
+		}
+	}
+
+	return c
+}
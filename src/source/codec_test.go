@@ -0,0 +1,36 @@
+package source
+
+import (
+	"testing"
+
+	"adts"
+	"protocol"
+)
+
+func TestProbed(t *testing.T) {
+	lc := adts.Info{AAC: true, Profile: protocol.PROFILE_AAC_LC, SampleRate: 22050, Channels: 2}
+	mono := lc
+	mono.Channels = 1
+
+	for _, x := range []struct {
+		name string
+		info adts.Info
+		ice  protocol.Codec
+		want protocol.Codec
+	}{
+		{"LC, no Ice-Audio-Info", lc, protocol.Codec{},
+			protocol.Codec{Codec: protocol.CODEC_AAC, Profile: protocol.PROFILE_AAC_LC, SampleRate: 22050, Channels: 2}},
+		{"LC as in Ice-Audio-Info", lc, protocol.Codec{SampleRate: 22050, Channels: 2},
+			protocol.Codec{Codec: protocol.CODEC_AAC, Profile: protocol.PROFILE_AAC_LC, SampleRate: 22050, Channels: 2}},
+		{"HE-AAC", lc, protocol.Codec{SampleRate: 44100, Channels: 2},
+			protocol.Codec{Codec: protocol.CODEC_AAC, Profile: protocol.PROFILE_HE_AAC, SampleRate: 44100, Channels: 2}},
+		{"HE-AACv2", mono, protocol.Codec{SampleRate: 44100, Channels: 2},
+			protocol.Codec{Codec: protocol.CODEC_AAC, Profile: protocol.PROFILE_HE_AAC_V2, SampleRate: 44100, Channels: 2}},
+		{"MP3", adts.Info{Profile: 3, SampleRate: 22050, Channels: 2}, protocol.Codec{SampleRate: 44100},
+			protocol.Codec{Codec: protocol.CODEC_MP3, Profile: protocol.PROFILE_MP3, SampleRate: 22050, Channels: 2}},
+	} {
+		if c := Probed(x.info, x.ice); c != x.want {
+			t.Errorf("%s: got %v, want %v", x.name, c, x.want)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package source
+
+import (
+	"log"
+	"os"
+
+	"config"
+)
+
+// Settings are those given as arguments, which the config file named
+// by CONFIG (if any) takes precedence over. Each program uses the
+// fields which apply to it.
+type Settings struct {
+	Listen       string   // hls: address to serve on
+	Server       string   // Icecast server streams are read from
+	Stream       string   // encoders: mountpoint to publish
+	Destinations []string // encoders: relays to send to
+	Streams      []string // hls: mountpoints to segment
+}
+
+// Load returns args with the config file's settings taken over them
+func Load(args Settings) (Settings, error) {
+	file := os.Getenv("CONFIG")
+	if file == "" {
+		return args, nil
+	}
+
+	c, err := config.Load(file)
+	if err != nil {
+		return args, err
+	}
+
+	return args.apply(c), nil
+}
+
+// Reload calls apply with args and the config file's settings over
+// them each time the file is read again (SIGHUP), if there is one
+func Reload(args Settings, apply func(Settings)) {
+	file := os.Getenv("CONFIG")
+	if file == "" {
+		return
+	}
+
+	config.Reload(file, func(c *config.Config) {
+		apply(args.apply(c))
+	})
+}
+
+// the config file's settings over s
+func (s Settings) apply(c *config.Config) Settings {
+	set := func(v *string, c string) {
+		if c != "" {
+			*v = c
+		}
+	}
+
+	set(&s.Listen, c.Listen)
+	set(&s.Server, c.Server)
+	set(&s.Stream, c.Stream)
+
+	if c.Destinations != nil {
+		s.Destinations = c.Destinations
+	}
+
+	if c.Streams != nil {
+		s.Streams = c.Streams
+	}
+
+	return s
+}
+
+// WarnRestart logs if the server, stream or address to serve on would
+// be changed by new settings, as they only take effect on a restart
+func (s Settings) WarnRestart(n Settings) {
+	if n.Listen != s.Listen || n.Server != s.Server || n.Stream != s.Stream {
+		log.Println("server, stream and listen need a restart to change")
+	}
+}
@@ -0,0 +1,66 @@
+// Package source is shared by the programs which read streams from an
+// Icecast server - the daveice and daveice2 encoders, which send them
+// on to relays, and hls.
+package source
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"mcast"
+	"protocol"
+)
+
+// Destination is a relay (or multicast group) an encoder sends to
+type Destination struct {
+	Arg   string        // as given, eg. "host@port,fec=5"
+	Addr  string        // "host:port"
+	UDP   bool          // given as "host@port"
+	FEC   int           // parity for every FEC PDUs of the stream if not 0
+	Mcast mcast.Options // for multicast groups
+}
+
+// ParseDestination reads "host:port" (TCP) or "host@port" (UDP), where
+// IPv6 addresses are written "[::1]:port" or "[::1]@port", optionally
+// followed by comma separated options, eg. "host@port,fec=5" or
+// "239.1.2.3@9000,ttl=4,if=eth1,loop=0" for a multicast group. Parity
+// (fec) needs protocol version 2.
+func ParseDestination(arg string, version int) (Destination, error) {
+	fields := strings.Split(arg, ",")
+	d := Destination{Arg: arg, Addr: fields[0], Mcast: mcast.Defaults}
+
+	if strings.Contains(d.Addr, "@") {
+		d.Addr = mcast.HostPort(d.Addr)
+		d.UDP = true
+	}
+
+	for _, o := range fields[1:] {
+		kv := strings.SplitN(o, "=", 2)
+		k, v := kv[0], ""
+		if len(kv) == 2 {
+			v = kv[1]
+		}
+
+		switch k {
+		case "fec":
+			f, err := strconv.Atoi(v)
+			if err != nil || f < 2 || f > protocol.MAX_GROUP {
+				return d, fmt.Errorf("fec must be 2 to %d", protocol.MAX_GROUP)
+			}
+			if version != 2 {
+				return d, errors.New("fec requires PROTOCOL=2")
+			}
+			d.FEC = f
+		case "ttl", "if", "loop":
+			if err := d.Mcast.Set(k, v); err != nil {
+				return d, err
+			}
+		default:
+			return d, fmt.Errorf("unknown option %s for %s", k, fields[0])
+		}
+	}
+
+	return d, nil
+}
@@ -0,0 +1,43 @@
+package source
+
+import (
+	"testing"
+
+	"mcast"
+)
+
+func TestParseDestination(t *testing.T) {
+	for _, x := range []struct {
+		arg  string
+		want Destination
+	}{
+		{"127.0.0.1:9001", Destination{Addr: "127.0.0.1:9001", Mcast: mcast.Defaults}},
+		{"127.0.0.1@9001,fec=5", Destination{Addr: "127.0.0.1:9001", UDP: true, FEC: 5, Mcast: mcast.Defaults}},
+		{"[::1]@9001", Destination{Addr: "[::1]:9001", UDP: true, Mcast: mcast.Defaults}},
+		{"239.1.2.3@9000,ttl=4,if=eth1,loop=0", Destination{Addr: "239.1.2.3:9000", UDP: true,
+			Mcast: mcast.Options{TTL: 4, Interface: "eth1"}}},
+	} {
+		d, err := ParseDestination(x.arg, 2)
+		x.want.Arg = x.arg
+
+		if err != nil || d != x.want {
+			t.Errorf("%s: got %+v, %v", x.arg, d, err)
+		}
+	}
+
+	for _, x := range []struct {
+		arg     string
+		version int
+	}{
+		{"127.0.0.1@9001,fec=5", 1}, // parity is version 2 only
+		{"127.0.0.1@9001,fec=1", 2},
+		{"127.0.0.1@9001,fec=256", 2},
+		{"239.1.2.3@9000,ttl=256", 2},
+		{"239.1.2.3@9000,ttl", 2},
+		{"127.0.0.1:9001,foo=1", 2},
+	} {
+		if _, err := ParseDestination(x.arg, x.version); err == nil {
+			t.Errorf("%s (version %d) accepted", x.arg, x.version)
+		}
+	}
+}
@@ -0,0 +1,251 @@
+package source
+
+import (
+	"errors"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"mcast"
+	"protocol"
+)
+
+// Relays sends the PDUs of an encoder's stream to each of its
+// destinations. The destinations may be replaced (eg. when the config
+// file is reloaded) while PDUs are being sent.
+type Relays struct {
+	Version int           // protocol version to emit, set with PROTOCOL=2
+	Key     *protocol.Key // signs PDUs if set, with KEYS=file KEY=id
+
+	depth   int // PDUs queued for each destination
+	seq     uint64
+	mu      sync.Mutex // for list
+	list    []*relay
+	started bool // destinations added later are logged
+}
+
+type relay struct {
+	dest    Destination
+	channel chan []byte
+	done    chan struct{} // closed if dropped from the destinations
+	fec     *protocol.FEC // parity for every N PDUs of the stream if set
+}
+
+// NewRelays returns Relays with no destinations, queueing up to depth
+// PDUs for each, and the protocol version and key given by the
+// environment (PROTOCOL, KEYS and KEY)
+func NewRelays(depth int) (*Relays, error) {
+	rs := &Relays{Version: 1, depth: depth}
+
+	if v, err := strconv.Atoi(os.Getenv("PROTOCOL")); err == nil {
+		if v != 1 && v != 2 {
+			return nil, errors.New("PROTOCOL must be 1 or 2")
+		}
+		rs.Version = v
+	}
+
+	if id := os.Getenv("KEY"); id != "" {
+		keys, err := protocol.LoadKeys(os.Getenv("KEYS"))
+		if err != nil {
+			return nil, err
+		}
+		if rs.Key = keys[id]; rs.Key == nil {
+			return nil, errors.New("no such key " + id)
+		}
+		if rs.Version != 2 {
+			return nil, errors.New("KEY requires PROTOCOL=2")
+		}
+	}
+
+	return rs, nil
+}
+
+// Update replaces the destinations, keeping the connections (and
+// parity state) of any unchanged. If any cannot be parsed the
+// destinations are left as they were.
+func (rs *Relays) Update(dests []string) error {
+	var list []*relay
+
+	for _, arg := range dests {
+		d, err := ParseDestination(arg, rs.Version)
+		if err != nil {
+			return err
+		}
+
+		r := &relay{dest: d, channel: make(chan []byte, rs.depth), done: make(chan struct{})}
+
+		if d.FEC > 0 {
+			r.fec = protocol.NewFEC(d.FEC)
+		}
+
+		list = append(list, r)
+	}
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	keep := make(map[string]*relay)
+	for _, r := range rs.list {
+		keep[r.dest.Arg] = r
+	}
+
+	for n, r := range list {
+		if k, ok := keep[r.dest.Arg]; ok {
+			list[n] = k
+			delete(keep, r.dest.Arg)
+		} else {
+			if rs.started {
+				log.Println("added", r.dest.Arg)
+			}
+			r.start()
+		}
+	}
+
+	for _, r := range keep {
+		log.Println("dropped", r.dest.Arg)
+		close(r.done)
+	}
+
+	rs.list = list
+	rs.started = true
+
+	return nil
+}
+
+// Send numbers a PDU and sends it to each destination, as a replica
+// numbered by the destination's position, followed by parity for the
+// destination's last N PDUs where due
+func (rs *Relays) Send(pdu protocol.PDU) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	pdu.Version = rs.Version
+	pdu.Seq = rs.seq
+	rs.seq++
+
+	for n, r := range rs.list {
+		pdu.Replica = uint8(n)
+		rs.send(r, &pdu)
+
+		if r.fec != nil {
+			if parity := r.fec.Add(&pdu); parity != nil {
+				rs.send(r, parity)
+			}
+		}
+	}
+}
+
+// Close stops sending to all of the destinations
+func (rs *Relays) Close() {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	for _, r := range rs.list {
+		close(r.done)
+	}
+
+	rs.list = nil
+}
+
+func (rs *Relays) send(r *relay, pdu *protocol.PDU) {
+	b, err := pdu.Marshal()
+	if err == nil && rs.Key != nil {
+		b, err = rs.Key.Sign(b)
+	}
+	if err != nil {
+		log.Println(pdu.Mountpoint, "Error encoding:", err)
+		return
+	}
+
+	select {
+	case r.channel <- b:
+	default:
+	}
+}
+
+func (r *relay) start() {
+	if r.dest.UDP {
+		go udp_client(r.dest.Addr, r.dest.Mcast, r.channel, r.done)
+	} else {
+		go tcp_client(r.dest.Addr, r.channel, r.done)
+	}
+}
+
+func udp_client(addr string, opts mcast.Options, messages chan []byte, done chan struct{}) {
+
+	defer func() {
+		select {
+		case <-done:
+			return
+		case <-time.After(3000 * time.Millisecond):
+		}
+		go udp_client(addr, opts, messages, done)
+	}()
+
+	// connect to this socket
+	conn, err := mcast.Dial(addr, opts)
+	if err != nil {
+		log.Println("Error connecting:", err)
+		return
+	}
+
+	defer conn.Close()
+
+	log.Printf("udp opened: %s\n", addr)
+
+	for {
+		var buff []byte
+		select {
+		case <-done:
+			return
+		case buff = <-messages:
+		}
+		if _, err := conn.Write(buff); err != nil {
+			log.Println("Error writing:", err.Error())
+			return
+		}
+	}
+}
+
+func tcp_client(addr string, messages chan []byte, done chan struct{}) {
+
+	defer func() {
+		select {
+		case <-done:
+			return
+		case <-time.After(3000 * time.Millisecond):
+		}
+		go tcp_client(addr, messages, done)
+	}()
+
+	// connect to this socket
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		log.Printf("tcp closing: %s\n", addr)
+		conn.Close()
+	}()
+
+	log.Printf("tcp opened: %s\n", addr)
+
+	nw := protocol.NewWriter(conn)
+
+	for {
+		var buff []byte
+		select {
+		case <-done:
+			return
+		case buff = <-messages:
+		}
+		if err := nw.WriteFrame(buff); err != nil {
+			log.Printf("Error writing: %v", err)
+			return
+		}
+	}
+}
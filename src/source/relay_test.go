@@ -0,0 +1,86 @@
+package source
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"protocol"
+)
+
+// nothing listens on port 1, so PDUs stay queued for each relay
+const (
+	A = "127.0.0.1:1"
+	B = "127.0.0.1:1,fec=2"
+	C = "[::1]:1"
+)
+
+func TestRelays(t *testing.T) {
+	rs := &Relays{Version: 2, depth: 10}
+	defer rs.Close()
+
+	if err := rs.Update([]string{A, B}); err != nil {
+		t.Fatal(err)
+	}
+
+	a, b := rs.list[0], rs.list[1]
+
+	rs.Send(protocol.PDU{Type: protocol.DATA, Data: make([]byte, 100)})
+	rs.Send(protocol.PDU{Type: protocol.DATA, Data: make([]byte, 200)})
+
+	if len(a.channel) != 2 || len(b.channel) != 3 {
+		t.Fatalf("queued %d and %d", len(a.channel), len(b.channel))
+	}
+
+	for n, want := range []struct {
+		typ     uint8
+		seq     uint64
+		replica uint8
+	}{{protocol.DATA, 0, 1}, {protocol.DATA, 1, 1}, {protocol.PARITY, 1, 1}} {
+		p, err := protocol.Unmarshal(<-b.channel)
+		if err != nil || p.Type != want.typ || p.Seq != want.seq || p.Replica != want.replica {
+			t.Errorf("%d: got %+v, %v", n, p, err)
+		}
+	}
+
+	// B is kept as it was, A dropped and C added
+	if err := rs.Update([]string{B, C}); err != nil {
+		t.Fatal(err)
+	}
+
+	if rs.list[0] != b || len(rs.list) != 2 {
+		t.Error("unchanged destination replaced")
+	}
+
+	select {
+	case <-a.done:
+	default:
+		t.Error("dropped destination not closed")
+	}
+
+	if err := rs.Update([]string{A, "127.0.0.1:1,foo=1"}); err == nil || rs.list[0] != b {
+		t.Error("bad destination accepted")
+	}
+}
+
+func TestSettings(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "daveice.json")
+	os.WriteFile(file, []byte(`{"stream": "Heart", "destinations": ["127.0.0.1:9001"]}`), 0644)
+
+	args := Settings{Server: "icecast:8000", Stream: "Capital", Destinations: []string{A, B}}
+
+	os.Setenv("CONFIG", "")
+	if s, err := Load(args); err != nil || !reflect.DeepEqual(s, args) {
+		t.Errorf("no file: got %+v, %v", s, err)
+	}
+
+	os.Setenv("CONFIG", file)
+	defer os.Setenv("CONFIG", "")
+
+	want := Settings{Server: "icecast:8000", Stream: "Heart", Destinations: []string{"127.0.0.1:9001"}}
+
+	if s, err := Load(args); err != nil || !reflect.DeepEqual(s, want) {
+		t.Errorf("got %+v, %v", s, err)
+	}
+}
@@ -0,0 +1,91 @@
+// Package splice finds where a backup stream carries on from the
+// frames last sent of a stream which has stalled. Both encoders of a
+// mountpoint encode the same programme, so rather than guessing from
+// when the frames arrived, the frames themselves can be matched and
+// the backup switched in with no audio repeated or missed.
+package splice
+
+import (
+	"bytes"
+)
+
+// how the backup was matched
+const (
+	PAYLOAD = "payload" // identical frames, eg. the same encoder output over two paths
+	SIZES   = "sizes"   // the same pattern of frame sizes from a second encoder
+
+	// not found here, but by the encoders' clocks (see protocol.FLAG_TIME)
+	TIMESTAMP = "timestamp"
+)
+
+// PAYLOAD_FRAMES identical frames, or SIZE_FRAMES frames of the same
+// sizes, are needed for a match. Frames sent are kept for the longer.
+const PAYLOAD_FRAMES = 8
+const SIZE_FRAMES = 32
+const FRAMES = SIZE_FRAMES
+
+// Find returns the index of the frame in backup which follows the last
+// frames of sent, and how it was found, or -1 if the streams cannot be
+// matched. Only matches within frames of near, the index arrival times
+// would give, are looked for - a backup which is behind will not have
+// the frames yet, and any earlier match is of repeated content. Where
+// identical frames repeat (eg. silence) the match nearest near is
+// taken. A pattern of sizes must only be found once, as constant
+// bitrate streams have frames which are all much the same size.
+func Find(sent, backup [][]byte, near, within int) (int, string) {
+	if i := find(sent, backup, PAYLOAD_FRAMES, near, within, bytes.Equal, false); i >= 0 {
+		return i, PAYLOAD
+	}
+
+	if i := find(sent, backup, SIZE_FRAMES, near, within, same_size, true); i >= 0 {
+		return i, SIZES
+	}
+
+	return -1, ""
+}
+
+func same_size(a, b []byte) bool {
+	return len(a) == len(b)
+}
+
+// index in backup after the last n frames of sent where they match
+func find(sent, backup [][]byte, n, near, within int, match func(a, b []byte) bool, unique bool) int {
+	if len(sent) < n {
+		return -1
+	}
+
+	sent = sent[len(sent)-n:]
+	best, found := -1, 0
+
+	for i := n; i <= len(backup); i++ {
+		if distance(i, near) > within {
+			continue
+		}
+
+		ok := true
+		for j := 0; j < n && ok; j++ {
+			ok = match(sent[j], backup[i-n+j])
+		}
+
+		if !ok {
+			continue
+		}
+
+		if found++; best < 0 || distance(i, near) < distance(best, near) {
+			best = i
+		}
+	}
+
+	if unique && found > 1 {
+		return -1
+	}
+
+	return best
+}
+
+func distance(a, b int) int {
+	if a < b {
+		return b - a
+	}
+	return a - b
+}
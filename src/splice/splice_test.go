@@ -0,0 +1,82 @@
+package splice
+
+import (
+	"testing"
+)
+
+// frames numbered from first, each of size(n) bytes with content n
+func frames(first, count int, size func(int) int) [][]byte {
+	var f [][]byte
+	for n := first; n < first+count; n++ {
+		b := make([]byte, size(n))
+		for i := range b {
+			b[i] = byte(n)
+		}
+		f = append(f, b)
+	}
+	return f
+}
+
+func fixed(int) int { return 139 }
+
+// sizes as a VBR encoder might produce, with nothing in common
+func varied(n int) int { return 100 + (n*7919)%97 }
+
+func TestPayload(t *testing.T) {
+	sent := frames(100, 40, fixed)   // 100-139 sent
+	backup := frames(90, 100, fixed) // 90-189 held
+
+	if i, how := Find(sent, backup, 0, 1000); i != 50 || how != PAYLOAD {
+		t.Errorf("got %d %q", i, how)
+	}
+
+	// frames repeat every 256, so take the one arrival time suggests
+	sent = frames(0, 300, fixed)
+	backup = frames(0, 600, fixed)
+
+	if i, _ := Find(sent, backup, 500, 1000); i != 556 {
+		t.Errorf("repeated: got %d", i)
+	}
+
+	if i, _ := Find(sent, backup, 200, 1000); i != 300 {
+		t.Errorf("repeated: got %d", i)
+	}
+
+	// the backup is behind, so the only match is of earlier content
+	if i, _ := Find(sent, backup[:400], 500, 50); i != -1 {
+		t.Errorf("outside window: got %d", i)
+	}
+
+	if i, how := Find(sent, frames(0, 100, varied), 50, 1000); i != -1 || how != "" {
+		t.Errorf("no match: got %d %q", i, how)
+	}
+
+	if i, _ := Find(sent[:PAYLOAD_FRAMES-1], backup, 0, 1000); i != -1 {
+		t.Errorf("too few sent: got %d", i)
+	}
+}
+
+func TestSizes(t *testing.T) {
+	sent := frames(0, 40, varied)
+	backup := frames(5, 100, varied)
+
+	for _, f := range backup {
+		f[0] = 0xff // a different encoder - never the same bytes
+	}
+
+	if i, how := Find(sent, backup, 0, 1000); i != 35 || how != SIZES {
+		t.Errorf("got %d %q", i, how)
+	}
+
+	// all the same size - could be anywhere
+	sent = frames(0, 40, fixed)
+	backup = frames(20, 100, fixed)
+
+	for _, f := range backup {
+		f[0] = 0xff
+	}
+
+	if i, _ := Find(sent, backup, 0, 1000); i != -1 {
+		t.Errorf("constant bitrate: got %d", i)
+	}
+}
@@ -0,0 +1,176 @@
+package status
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"html/template"
+	"io"
+	"net"
+)
+
+// times as formatted by Icecast
+const (
+	ICECAST_TIME    = "Mon, 02 Jan 2006 15:04:05 -0700"
+	ICECAST_ISO8601 = "2006-01-02T15:04:05-0700"
+)
+
+// Icestats is the server and its mountpoints in the form given by
+// Icecast's status-json.xsl and admin/stats, for existing tools
+type Icestats struct {
+	XMLName            xml.Name `json:"-" xml:"icestats"`
+	Admin              string   `json:"admin" xml:"admin"`
+	Host               string   `json:"host" xml:"host"`
+	Location           string   `json:"location" xml:"location"`
+	ServerID           string   `json:"server_id" xml:"server_id"`
+	ServerStart        string   `json:"server_start" xml:"server_start"`
+	ServerStartISO8601 string   `json:"server_start_iso8601" xml:"server_start_iso8601"`
+	Clients            int      `json:"-" xml:"clients"`
+	Listeners          int      `json:"-" xml:"listeners"`
+	Sources            int      `json:"-" xml:"sources"`
+	Source             []Source `json:"-" xml:"source"`
+}
+
+// Source is a mountpoint in Icestats
+type Source struct {
+	Mount              string `json:"-" xml:"mount,attr"`
+	AudioInfo          string `json:"audio_info" xml:"audio_info"`
+	Bitrate            int    `json:"bitrate" xml:"bitrate"`
+	Channels           int    `json:"channels" xml:"channels"`
+	Genre              string `json:"genre,omitempty" xml:"genre,omitempty"`
+	ListenerPeak       int    `json:"listener_peak" xml:"listener_peak"`
+	Listeners          int    `json:"listeners" xml:"listeners"`
+	ListenURL          string `json:"listenurl" xml:"listenurl"`
+	MaxListeners       string `json:"-" xml:"max_listeners"`
+	Public             int    `json:"-" xml:"public"`
+	SampleRate         int    `json:"samplerate" xml:"samplerate"`
+	ServerDescription  string `json:"server_description,omitempty" xml:"server_description,omitempty"`
+	ServerName         string `json:"server_name,omitempty" xml:"server_name,omitempty"`
+	ServerType         string `json:"server_type" xml:"server_type"`
+	ServerURL          string `json:"server_url,omitempty" xml:"server_url,omitempty"`
+	SlowListeners      int    `json:"-" xml:"slow_listeners"`
+	StreamStart        string `json:"stream_start" xml:"stream_start"`
+	StreamStartISO8601 string `json:"stream_start_iso8601" xml:"stream_start_iso8601"`
+	Artist             string `json:"artist,omitempty" xml:"artist,omitempty"`
+	Title              string `json:"title,omitempty" xml:"title,omitempty"`
+	TotalBytesRead     uint64 `json:"-" xml:"total_bytes_read"`
+	TotalBytesSent     uint64 `json:"-" xml:"total_bytes_sent"`
+}
+
+// Icestats returns the current state as Icecast would present it for
+// a server known as id (eg. "Icecast 2.3.3-kh11") at host (host:port)
+func (r *Registry) Icestats(id, host string) *Icestats {
+	mounts, _ := r.Mountpoints()
+
+	r.mu.Lock()
+	started := r.started
+	r.mu.Unlock()
+
+	hostname := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		hostname = h
+	}
+
+	i := &Icestats{Admin: "icemaster@localhost", Host: hostname, Location: "Earth",
+		ServerID: id, ServerStart: started.Format(ICECAST_TIME),
+		ServerStartISO8601: started.Format(ICECAST_ISO8601), Sources: len(mounts)}
+
+	for _, m := range mounts {
+		c := m.Codec
+
+		i.Listeners += m.Listeners
+		i.Source = append(i.Source, Source{
+			Mount: "/" + m.Name,
+			AudioInfo: fmt.Sprintf("channels=%d;samplerate=%d;bitrate=%d",
+				c.Channels, c.SampleRate, c.Kbps()),
+			Bitrate:            c.Kbps(),
+			Channels:           int(c.Channels),
+			Genre:              m.Headers["Icy-Genre"],
+			ListenerPeak:       m.ListenerPeak,
+			Listeners:          m.Listeners,
+			ListenURL:          "http://" + host + "/" + m.Name,
+			MaxListeners:       "unlimited",
+			SampleRate:         int(c.SampleRate),
+			ServerDescription:  m.Headers["Icy-Description"],
+			ServerName:         m.Headers["Icy-Name"],
+			ServerType:         c.ContentType(),
+			ServerURL:          m.Headers["Icy-Url"],
+			StreamStart:        m.Started.Format(ICECAST_TIME),
+			StreamStartISO8601: m.Started.Format(ICECAST_ISO8601),
+			Artist:             m.Metadata.Artist,
+			Title:              m.Metadata.StreamTitle,
+			TotalBytesRead:     m.BytesRead,
+			TotalBytesSent:     m.BytesSent,
+		})
+	}
+
+	i.Clients = i.Listeners
+
+	return i
+}
+
+// MarshalJSON wraps the stats in an "icestats" object as Icecast does,
+// including its quirk of giving a lone source as an object rather
+// than an array of one, which clients have come to expect
+func (i *Icestats) MarshalJSON() ([]byte, error) {
+	type icestats Icestats
+
+	var source interface{}
+
+	switch len(i.Source) {
+	case 0:
+	case 1:
+		source = i.Source[0]
+	default:
+		source = i.Source
+	}
+
+	return json.Marshal(map[string]interface{}{"icestats": struct {
+		*icestats
+		Source interface{} `json:"source,omitempty"`
+	}{(*icestats)(i), source}})
+}
+
+// WriteXML writes the stats as returned by Icecast's admin/stats
+func (i *Icestats) WriteXML(w io.Writer) error {
+	io.WriteString(w, xml.Header)
+	e := xml.NewEncoder(w)
+	e.Indent("", "  ")
+	if err := e.Encode(i); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+var statusPage = template.Must(template.New("status").Parse(`<!DOCTYPE html>
+<html>
+<head><title>{{.ServerID}} Status</title></head>
+<body>
+<h2>{{.ServerID}} Status</h2>
+{{range .Source}}
+<div class="roundbox">
+<h3>Mount Point {{.Mount}}</h3>
+<table>
+{{if .ServerName}}<tr><td>Stream Name:</td><td>{{.ServerName}}</td></tr>{{end}}
+{{if .ServerDescription}}<tr><td>Stream Description:</td><td>{{.ServerDescription}}</td></tr>{{end}}
+<tr><td>Content Type:</td><td>{{.ServerType}}</td></tr>
+<tr><td>Stream started:</td><td>{{.StreamStart}}</td></tr>
+<tr><td>Bitrate:</td><td>{{.Bitrate}}</td></tr>
+<tr><td>Listeners (current):</td><td>{{.Listeners}}</td></tr>
+<tr><td>Listeners (peak):</td><td>{{.ListenerPeak}}</td></tr>
+{{if .Genre}}<tr><td>Genre:</td><td>{{.Genre}}</td></tr>{{end}}
+{{if .ServerURL}}<tr><td>Stream URL:</td><td><a href="{{.ServerURL}}">{{.ServerURL}}</a></td></tr>{{end}}
+<tr><td>Currently playing:</td><td>{{.Title}}</td></tr>
+</table>
+<p><a href="{{.ListenURL}}">{{.ListenURL}}</a></p>
+</div>
+{{end}}
+</body>
+</html>
+`))
+
+// WriteHTML writes a page like Icecast's status.xsl
+func (i *Icestats) WriteHTML(w io.Writer) error {
+	return statusPage.Execute(w, i)
+}
@@ -0,0 +1,224 @@
+// Package status keeps the state of an edge's mountpoints and streams
+// for the admin API. The goroutines which handle each mountpoint and
+// stream update their own entry; readers take a copy of the whole.
+// Counters which change with every frame or write are kept apart, so
+// that they can be added to without taking the registry's lock.
+package status
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"protocol"
+)
+
+// Registry holds the current mountpoints and streams. Entries are
+// created and removed by their owners, who keep a pointer to update.
+type Registry struct {
+	mu      sync.Mutex
+	mounts  map[string]*Mountpoint
+	streams map[string]*Stream
+	started time.Time
+}
+
+// Mountpoint is the state of a mountpoint and its listeners
+type Mountpoint struct {
+	r     *Registry
+	count *counters // BytesRead, BytesSent and Gaps
+
+	Name         string            `json:"mountpoint"`
+	Codec        protocol.Codec    `json:"-"`
+	Active       string            `json:"active"`  // uuid of stream being sent
+	Backups      []Backup          `json:"backups"` // other streams, held for failover
+	Metadata     protocol.Metadata `json:"metadata"`
+	Headers      map[string]string `json:"headers"` // from the source, eg. Icy-Name
+	Listeners    int               `json:"listeners"`
+	ListenerPeak int               `json:"listener_peak"`
+	BytesRead    uint64            `json:"bytes_read"` // audio from the active stream, see Read
+	BytesSent    uint64            `json:"bytes_sent"` // see Sent
+	Failovers    uint64            `json:"failovers"`
+	LastFailover *time.Time        `json:"last_failover,omitempty"`
+	Gaps         uint64            `json:"gaps"` // non-contiguous PDUs sent to listeners, see Gap
+	Timing       Timing            `json:"timing"`
+	Started      time.Time         `json:"started"`
+}
+
+type counters struct {
+	read, sent, gaps atomic.Uint64
+}
+
+// Timing is the failover timing in effect for a mountpoint, in seconds
+type Timing struct {
+	Blip  float64 `json:"blip"`  // stream considered stalled
+	Fail  float64 `json:"fail"`  // mountpoint given up
+	Stall float64 `json:"stall"` // stream considered stalled if a backup is ready (0 - never)
+	Sync  float64 `json:"sync"`  // stalled stream resynchronised
+	Dead  float64 `json:"dead"`  // stream expired
+}
+
+// Backup is a stream held by a mountpoint in case the active one fails
+type Backup struct {
+	UUID  string `json:"uuid"`
+	Depth int    `json:"depth"` // PDUs buffered
+}
+
+// Stream is the state of a single encoded stream (one uuid)
+type Stream struct {
+	r *Registry
+
+	UUID       string `json:"uuid"`
+	Mountpoint string `json:"mountpoint"`
+	Seq        uint64 `json:"seq"`       // next expected sequence number
+	Reorder    int    `json:"reorder"`   // PDUs waiting in reorder buffer
+	Gaps       uint64 `json:"gaps"`      // sequence numbers found missing
+	Requested  uint64 `json:"requested"` // sequence numbers NAKed
+	Recovered  uint64 `json:"recovered"` // PDUs rebuilt from parity
+	Resyncs    uint64 `json:"resyncs"`
+}
+
+func New() *Registry {
+	return &Registry{mounts: make(map[string]*Mountpoint), streams: make(map[string]*Stream),
+		started: time.Now()}
+}
+
+// AddMountpoint creates an entry for a mountpoint, replacing any other
+func (r *Registry) AddMountpoint(name string, codec protocol.Codec) *Mountpoint {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	m := &Mountpoint{r: r, count: &counters{}, Name: name, Codec: codec,
+		Headers: map[string]string{}, Started: time.Now()}
+	r.mounts[name] = m
+
+	return m
+}
+
+// Remove drops the mountpoint's entry if it has not been replaced.
+// Updates to a removed entry are harmless.
+func (m *Mountpoint) Remove() {
+	m.r.mu.Lock()
+	defer m.r.mu.Unlock()
+
+	if m.r.mounts[m.Name] == m {
+		delete(m.r.mounts, m.Name)
+	}
+}
+
+// Update calls f with the registry locked
+func (m *Mountpoint) Update(f func(*Mountpoint)) {
+	m.r.mu.Lock()
+	defer m.r.mu.Unlock()
+	f(m)
+}
+
+// Read counts audio read from the active stream
+func (m *Mountpoint) Read(n int) {
+	m.count.read.Add(uint64(n))
+}
+
+// Sent counts audio sent to a listener
+func (m *Mountpoint) Sent(n int) {
+	m.count.sent.Add(uint64(n))
+}
+
+// Gap counts a PDU sent to listeners which did not follow the last
+func (m *Mountpoint) Gap() {
+	m.count.gaps.Add(1)
+}
+
+// AddStream creates an entry for a stream, replacing any other
+func (r *Registry) AddStream(uuid string) *Stream {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s := &Stream{r: r, UUID: uuid}
+	r.streams[uuid] = s
+
+	return s
+}
+
+// Remove drops the stream's entry if it has not been replaced
+func (s *Stream) Remove() {
+	s.r.mu.Lock()
+	defer s.r.mu.Unlock()
+
+	if s.r.streams[s.UUID] == s {
+		delete(s.r.streams, s.UUID)
+	}
+}
+
+// Update calls f with the registry locked
+func (s *Stream) Update(f func(*Stream)) {
+	s.r.mu.Lock()
+	defer s.r.mu.Unlock()
+	f(s)
+}
+
+// Mountpoints returns copies of the mountpoints in order of name, with
+// the streams of each (in order of uuid)
+func (r *Registry) Mountpoints() ([]Mountpoint, map[string][]Stream) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	mounts := make([]Mountpoint, 0, len(r.mounts))
+	for _, m := range r.mounts {
+		c := *m
+		c.Backups = append([]Backup{}, m.Backups...)
+		c.BytesRead = m.count.read.Load()
+		c.BytesSent = m.count.sent.Load()
+		c.Gaps = m.count.gaps.Load()
+		mounts = append(mounts, c)
+	}
+	sort.Slice(mounts, func(i, j int) bool { return mounts[i].Name < mounts[j].Name })
+
+	streams := make(map[string][]Stream)
+	for _, s := range r.streams {
+		streams[s.Mountpoint] = append(streams[s.Mountpoint], *s)
+	}
+	for _, l := range streams {
+		sort.Slice(l, func(i, j int) bool { return l[i].UUID < l[j].UUID })
+	}
+
+	return mounts, streams
+}
+
+// Report is a mountpoint as presented by the admin API
+type Report struct {
+	Mountpoint
+	Codec       string   `json:"codec"`
+	ContentType string   `json:"content_type"`
+	Bitrate     int      `json:"bitrate"` // kbps
+	SampleRate  uint32   `json:"samplerate"`
+	Channels    uint8    `json:"channels"`
+	Streams     []Stream `json:"streams"`
+}
+
+// Report returns the named mountpoints, or all if none are named
+func (r *Registry) Report(names ...string) []Report {
+	mounts, streams := r.Mountpoints()
+	reports := []Report{}
+
+	for _, m := range mounts {
+		if len(names) > 0 && !contains(names, m.Name) {
+			continue
+		}
+
+		reports = append(reports, Report{Mountpoint: m, Codec: m.Codec.String(),
+			ContentType: m.Codec.ContentType(), Bitrate: m.Codec.Kbps(),
+			SampleRate: m.Codec.SampleRate, Channels: m.Codec.Channels,
+			Streams: append([]Stream{}, streams[m.Name]...)})
+	}
+
+	return reports
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,117 @@
+package status
+
+import (
+	"bytes"
+	"encoding/json"
+	"protocol"
+	"strings"
+	"testing"
+)
+
+func TestRegistry(t *testing.T) {
+	r := New()
+
+	old := r.AddMountpoint("Capital", protocol.LegacyCodec(protocol.AAC_2C_44100_48000))
+	m := r.AddMountpoint("Capital", protocol.LegacyCodec(protocol.AAC_2C_44100_48000))
+	r.AddMountpoint("Heart", protocol.LegacyCodec(protocol.MP3_2C_44100_128000))
+
+	old.Update(func(m *Mountpoint) { m.Listeners++ })
+	old.Remove() // replaced, so has no effect
+
+	m.Update(func(m *Mountpoint) {
+		m.Listeners = 2
+		m.Backups = append(m.Backups, Backup{UUID: "b", Depth: 10})
+	})
+
+	m.Read(100)
+	m.Sent(100)
+	m.Sent(50)
+	m.Gap()
+
+	s := r.AddStream("a")
+	s.Update(func(s *Stream) { s.Mountpoint = "Capital"; s.Gaps = 3 })
+	r.AddStream("b").Update(func(s *Stream) { s.Mountpoint = "Capital" })
+
+	reports := r.Report()
+
+	if len(reports) != 2 || reports[0].Name != "Capital" || reports[1].Name != "Heart" {
+		t.Fatalf("got %+v", reports)
+	}
+
+	c := reports[0]
+
+	if c.Listeners != 2 || len(c.Backups) != 1 || c.Bitrate != 48 || c.ContentType != "audio/aacp" {
+		t.Errorf("got %+v", c)
+	}
+
+	if c.BytesRead != 100 || c.BytesSent != 150 || c.Gaps != 1 {
+		t.Errorf("counters: got %d read, %d sent, %d gaps", c.BytesRead, c.BytesSent, c.Gaps)
+	}
+
+	if len(c.Streams) != 2 || c.Streams[0].UUID != "a" || c.Streams[0].Gaps != 3 {
+		t.Errorf("streams: got %+v", c.Streams)
+	}
+
+	// reports are copies
+	m.Update(func(m *Mountpoint) { m.Backups[0].Depth = 20 })
+	if c.Backups[0].Depth != 10 {
+		t.Errorf("report changed with mountpoint")
+	}
+
+	m.Remove()
+	s.Remove()
+
+	if reports = r.Report("Capital", "Heart"); len(reports) != 1 || len(r.Report("Capital")) != 0 {
+		t.Errorf("after remove: got %+v", reports)
+	}
+}
+
+func TestIcestats(t *testing.T) {
+	r := New()
+
+	decode := func() map[string]interface{} {
+		b, err := json.Marshal(r.Icestats("Icecast 2.3.3-kh11", "edge:8000"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var v map[string]map[string]interface{}
+		if err := json.Unmarshal(b, &v); err != nil {
+			t.Fatal(err)
+		}
+		return v["icestats"]
+	}
+
+	if _, ok := decode()["source"]; ok {
+		t.Errorf("source given with no mountpoints")
+	}
+
+	m := r.AddMountpoint("Capital", protocol.LegacyCodec(protocol.AAC_2C_44100_48000))
+	m.Update(func(m *Mountpoint) {
+		m.Listeners = 3
+		m.Headers["Icy-Name"] = "Capital FM"
+		m.Metadata = protocol.Metadata{StreamTitle: "A - B", Artist: "A", Title: "B"}
+	})
+
+	// a lone source is an object, as with Icecast
+	source, ok := decode()["source"].(map[string]interface{})
+	if !ok || source["listenurl"] != "http://edge:8000/Capital" || source["title"] != "A - B" ||
+		source["server_name"] != "Capital FM" || source["listeners"] != 3.0 {
+		t.Errorf("source: got %v", source)
+	}
+
+	r.AddMountpoint("Heart", protocol.LegacyCodec(protocol.MP3_2C_44100_128000))
+
+	if sources, ok := decode()["source"].([]interface{}); !ok || len(sources) != 2 {
+		t.Errorf("sources: got %v", decode()["source"])
+	}
+
+	var b bytes.Buffer
+	r.Icestats("Icecast 2.3.3-kh11", "edge:8000").WriteXML(&b)
+
+	for _, s := range []string{"<icestats>", "<listeners>3</listeners>", "<sources>2</sources>",
+		`<source mount="/Capital">`, "<server_type>audio/mpeg</server_type>"} {
+		if !strings.Contains(b.String(), s) {
+			t.Errorf("xml: no %s in %s", s, b.String())
+		}
+	}
+}
@@ -0,0 +1,128 @@
+// Package transport provides the TCP connections used between
+// davecast nodes, with connect, read and write deadlines, TCP
+// keepalive and socket buffer sizes. It replaces the cgo netc
+// package and has the same Dial/Listen/Read/Write surface.
+package transport
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// Config for a connection; zero values leave the system default (or
+// no deadline) in place
+type Config struct {
+	ConnectTimeout time.Duration // for Dial to complete
+	ReadTimeout    time.Duration // longest a Read may wait for data
+	WriteTimeout   time.Duration // longest a Write may wait for the peer
+	KeepAlive      time.Duration // TCP keepalive period, negative to disable
+	ReadBuffer     int           // SO_RCVBUF in bytes
+	WriteBuffer    int           // SO_SNDBUF in bytes
+}
+
+// as netc did: 30s receive timeout
+var Defaults = Config{
+	ConnectTimeout: 10 * time.Second,
+	ReadTimeout:    30 * time.Second,
+	WriteTimeout:   30 * time.Second,
+	KeepAlive:      15 * time.Second,
+}
+
+// A Conn is a TCP connection which applies the configured deadline
+// to each Read and Write
+type Conn struct {
+	*net.TCPConn
+	config Config
+}
+
+// Dial connects to address ("host:port", "[ipv6]:port") on network
+// "tcp", "tcp4" or "tcp6"
+func Dial(network, address string, config Config) (*Conn, error) {
+	d := net.Dialer{Timeout: config.ConnectTimeout, KeepAlive: config.KeepAlive}
+
+	c, err := d.Dial(network, address)
+	if err != nil {
+		return nil, fmt.Errorf("transport: dial %s: %w", address, err)
+	}
+
+	return wrap(c.(*net.TCPConn), config)
+}
+
+func wrap(c *net.TCPConn, config Config) (*Conn, error) {
+	if config.ReadBuffer > 0 {
+		if err := c.SetReadBuffer(config.ReadBuffer); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("transport: read buffer: %w", err)
+		}
+	}
+
+	if config.WriteBuffer > 0 {
+		if err := c.SetWriteBuffer(config.WriteBuffer); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("transport: write buffer: %w", err)
+		}
+	}
+
+	return &Conn{TCPConn: c, config: config}, nil
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	if c.config.ReadTimeout > 0 {
+		c.SetReadDeadline(time.Now().Add(c.config.ReadTimeout))
+	}
+
+	n, err := c.TCPConn.Read(p)
+	if err != nil && err != io.EOF {
+		err = fmt.Errorf("transport: read %v: %w", c.RemoteAddr(), err)
+	}
+
+	return n, err
+}
+
+func (c *Conn) Write(p []byte) (int, error) {
+	if c.config.WriteTimeout > 0 {
+		c.SetWriteDeadline(time.Now().Add(c.config.WriteTimeout))
+	}
+
+	n, err := c.TCPConn.Write(p)
+	if err != nil {
+		return n, fmt.Errorf("transport: write %v: %w", c.RemoteAddr(), err)
+	}
+
+	return n, nil
+}
+
+// A Listener accepts connections with the configuration applied
+type Listener struct {
+	*net.TCPListener
+	config Config
+}
+
+// Listen on address - ":port" for every IPv4 and IPv6 address
+func Listen(network, address string, config Config) (*Listener, error) {
+	lc := net.ListenConfig{KeepAlive: config.KeepAlive}
+
+	l, err := lc.Listen(context.Background(), network, address)
+	if err != nil {
+		return nil, fmt.Errorf("transport: listen %s: %w", address, err)
+	}
+
+	return &Listener{TCPListener: l.(*net.TCPListener), config: config}, nil
+}
+
+func (l *Listener) Accept() (*Conn, error) {
+	c, err := l.AcceptTCP()
+	if err != nil {
+		return nil, fmt.Errorf("transport: accept: %w", err)
+	}
+
+	if l.config.KeepAlive > 0 {
+		c.SetKeepAlive(true)
+		c.SetKeepAlivePeriod(l.config.KeepAlive)
+	}
+
+	return wrap(c, l.config)
+}
@@ -0,0 +1,97 @@
+package transport
+
+import (
+	"errors"
+	"io"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// a connected pair, with config on the dialled end
+func pair(t *testing.T, config Config) (*Conn, *Conn) {
+	l, err := Listen("tcp", "127.0.0.1:0", Defaults)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	accepted := make(chan *Conn, 1)
+	go func() {
+		c, _ := l.Accept()
+		accepted <- c
+	}()
+
+	c, err := Dial("tcp", l.Addr().String(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := <-accepted
+	if s == nil {
+		t.Fatal("accept failed")
+	}
+
+	t.Cleanup(func() { c.Close(); s.Close() })
+
+	return c, s
+}
+
+func TestConn(t *testing.T) {
+	c, s := pair(t, Config{ReadBuffer: 65536, WriteBuffer: 65536})
+
+	if _, err := s.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	b := make([]byte, 5)
+	if _, err := io.ReadFull(c, b); err != nil || string(b) != "hello" {
+		t.Errorf("got %q, %v", b, err)
+	}
+
+	s.Close()
+
+	if _, err := c.Read(b); err != io.EOF {
+		t.Errorf("got %v, want EOF", err)
+	}
+}
+
+func TestReadTimeout(t *testing.T) {
+	c, _ := pair(t, Config{ReadTimeout: 50 * time.Millisecond})
+
+	if _, err := c.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("got %v, want a timeout", err)
+	}
+
+	// with no deadline an idle connection is left open
+	c, s := pair(t, Config{})
+
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		s.Write([]byte("x"))
+	}()
+
+	if _, err := c.Read(make([]byte, 1)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	l, err := Listen("tcp", "127.0.0.1:0", Defaults)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := l.Addr().String()
+
+	if _, err := Listen("tcp", addr, Defaults); !errors.Is(err, syscall.EADDRINUSE) {
+		t.Errorf("listen: got %v", err)
+	}
+
+	l.Close()
+
+	if _, err := Dial("tcp", addr, Defaults); !errors.Is(err, syscall.ECONNREFUSED) {
+		t.Errorf("dial: got %v", err)
+	}
+}